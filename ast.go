@@ -0,0 +1,116 @@
+package gript
+
+//The expression tree built by Parse is made of the nodes IntLiteral, FloatLiteral, StringLiteral, PatternLiteral,
+//Identifier, ListLiteral, MapLiteral, MemberExpression, IndexExpression, CallExpression, UnaryExpression,
+//BinaryExpression and ConditionalExpression. Walk, Inspect and Rewrite traverse it; other implementations
+//of Expression are seen as leaves.
+
+//Visitor visits the nodes of an expression tree with Walk
+type Visitor interface {
+	Visit(e Expression) (w Visitor)
+}
+
+//Walk traverses an expression tree in depth-first order: it starts by calling v.Visit(e); if the returned visitor w
+//is not nil, Walk is called recursively with w for each operand of e, followed by a call of w.Visit(nil).
+func Walk(v Visitor, e Expression) {
+	if v = v.Visit(e); v == nil {
+		return
+	}
+	for _, child := range children(e) {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Expression) bool
+
+func (f inspector) Visit(e Expression) Visitor {
+	if f(e) {
+		return f
+	}
+	return nil
+}
+
+//Inspect traverses an expression tree in depth-first order: it starts by calling f(e); if f returns true,
+//Inspect is called recursively for each operand of e, followed by a call of f(nil).
+func Inspect(e Expression, f func(Expression) bool) {
+	Walk(inspector(f), e)
+}
+
+//Rewrite rebuilds an expression tree bottom-up: the operands of e are rewritten first, then f is called
+//with e rebuilt from the rewritten operands, and its result replaces e. The original tree is left unchanged.
+func Rewrite(e Expression, f func(Expression) Expression) Expression {
+	operands := children(e)
+	if len(operands) > 0 {
+		rewritten := make([]Expression, len(operands))
+		for i, operand := range operands {
+			rewritten[i] = Rewrite(operand, f)
+		}
+		e = withChildren(e, rewritten)
+	}
+	return f(e)
+}
+
+//children returns the operands of an expression
+func children(e Expression) []Expression {
+
+	switch e := e.(type) {
+	case ListLiteral:
+		return e.Items
+	case MapLiteral:
+		c := make([]Expression, 0, 2*len(e.Entries))
+		for _, entry := range e.Entries {
+			c = append(c, entry.Key, entry.Value)
+		}
+		return c
+	case MemberExpression:
+		return []Expression{e.Object}
+	case IndexExpression:
+		return []Expression{e.Object, e.Index}
+	case CallExpression:
+		return e.Args
+	case UnaryExpression:
+		return []Expression{e.Operand}
+	case BinaryExpression:
+		return []Expression{e.Left, e.Right}
+	case ConditionalExpression:
+		return []Expression{e.Condition, e.Yes, e.No}
+	}
+	return nil
+}
+
+//withChildren returns a copy of an expression with other operands, given in the order of children
+func withChildren(e Expression, c []Expression) Expression {
+
+	switch e := e.(type) {
+	case ListLiteral:
+		e.Items = c
+		return e
+	case MapLiteral:
+		entries := make([]MapEntry, len(e.Entries))
+		for i := range entries {
+			entries[i] = MapEntry{c[2*i], c[2*i+1]}
+		}
+		e.Entries = entries
+		return e
+	case MemberExpression:
+		e.Object = c[0]
+		return e
+	case IndexExpression:
+		e.Object, e.Index = c[0], c[1]
+		return e
+	case CallExpression:
+		e.Args = c
+		return e
+	case UnaryExpression:
+		e.Operand = c[0]
+		return e
+	case BinaryExpression:
+		e.Left, e.Right = c[0], c[1]
+		return e
+	case ConditionalExpression:
+		e.Condition, e.Yes, e.No = c[0], c[1], c[2]
+		return e
+	}
+	return e
+}
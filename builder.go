@@ -0,0 +1,269 @@
+package gript
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//The functions below build expression trees as Parse does, to be compiled by CompileExpression or rendered as source
+//by Format, the literals being quoted as needed:
+//
+// name, err := gript.Var("user.name")
+// if err != nil {
+// 	return err
+// }
+// e := gript.And(gript.Ne(name, gript.Nil()), gript.Eq(name, gript.String("it's")))
+// gript.Format(e) // user.name != nil && user.name == "it's"
+
+//Var returns the variable of a path of names separated by dots, as 'user.name'. The names following the variable
+//that are not identifiers are accessed by index, as in "headers['x-request-id']".
+//Var fails when the variable, first in the path, is not an identifier, as in 'x-request-id', or when a name is empty,
+//as in 'a..b'.
+func Var(path string) (Expression, error) {
+	names := strings.Split(path, ".")
+	if !isIdentifier(names[0]) {
+		return nil, fmt.Errorf("invalid variable name '%s'", names[0])
+	}
+	var e Expression = Identifier{Name: names[0]}
+	for _, name := range names[1:] {
+		if name == "" {
+			return nil, fmt.Errorf("empty name in variable path '%s'", path)
+		}
+		if isIdentifier(name) {
+			e = MemberExpression{Object: e, Name: name}
+		} else {
+			e = IndexExpression{Object: e, Index: StringLiteral{Value: name}}
+		}
+	}
+	return e, nil
+}
+
+//Member returns the access to a field of an object, as 'o.name'
+func Member(object Expression, name string) Expression {
+	return MemberExpression{Object: object, Name: name}
+}
+
+//OptionalMember returns the optional access to a field of an object, as 'o?.name'
+func OptionalMember(object Expression, name string) Expression {
+	return MemberExpression{Object: object, Name: name, Optional: true}
+}
+
+//Index returns the access to an element of a list or a map, as 'o[i]'
+func Index(object, index Expression) Expression {
+	return IndexExpression{Object: object, Index: index}
+}
+
+//Call returns the call of a function, as 'f(a, b)'
+func Call(function string, args ...Expression) Expression {
+	if args == nil {
+		args = []Expression{}
+	}
+	return CallExpression{Function: function, Args: args}
+}
+
+//Int returns an int literal, a negative value being negated as in '-1'
+func Int(v int) Expression {
+	if v < 0 && -v > 0 {
+		return UnaryExpression{Operator: "-", Operand: IntLiteral{Value: -v}}
+	}
+	return IntLiteral{Value: v}
+}
+
+//Float returns a float literal, a negative value being negated as in '-1.5'
+func Float(v float64) Expression {
+	if v < 0 || (v == 0 && math.Signbit(v)) {
+		return UnaryExpression{Operator: "-", Operand: FloatLiteral{Value: -v}}
+	}
+	return FloatLiteral{Value: v}
+}
+
+//String returns a string literal
+func String(v string) Expression {
+	return StringLiteral{Value: v}
+}
+
+//Bool returns true or false
+func Bool(v bool) Expression {
+	if v {
+		return Identifier{Name: "true"}
+	}
+	return Identifier{Name: "false"}
+}
+
+//Nil returns nil
+func Nil() Expression {
+	return Identifier{Name: "nil"}
+}
+
+//List returns a list literal, as '[a, b]'
+func List(items ...Expression) Expression {
+	if items == nil {
+		items = []Expression{}
+	}
+	return ListLiteral{Items: items}
+}
+
+//Map returns a map literal, as '{k: v}'
+func Map(entries ...MapEntry) Expression {
+	return MapLiteral{Entries: entries}
+}
+
+//Entry returns an entry of a map literal
+func Entry(key, value Expression) MapEntry {
+	return MapEntry{Key: key, Value: value}
+}
+
+//Value returns the literal of a Go value: a bool, a number, a string or nil, or a slice, an array or a map of such values.
+//It fails for values of other types.
+func Value(v interface{}) (Expression, error) {
+
+	if v == nil {
+		return Nil(), nil
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Bool:
+		return Bool(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Int(int(value.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := value.Uint(); u <= uint64(maxInt) {
+			return Int(int(u)), nil
+		}
+		//As normalize does, integers out of the range of int are converted to float64
+		return Float(float64(value.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return Float(value.Float()), nil
+	case reflect.String:
+		return String(value.String()), nil
+	case reflect.Slice, reflect.Array:
+		items := make([]Expression, value.Len())
+		for i := range items {
+			item, err := Value(value.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return List(items...), nil
+	case reflect.Map:
+		var entries []MapEntry
+		iter := value.MapRange()
+		for iter.Next() {
+			key, err := Value(iter.Key().Interface())
+			if err != nil {
+				return nil, err
+			}
+			v, err := Value(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, Entry(key, v))
+		}
+		//Sort the entries by key, for a stable source
+		sort.Slice(entries, func(i, j int) bool { return Format(entries[i].Key) < Format(entries[j].Key) })
+		return Map(entries...), nil
+	}
+	return nil, fmt.Errorf("no literal for a value of type %T", v)
+}
+
+//Not returns the logical negation '!e'
+func Not(e Expression) Expression {
+	return UnaryExpression{Operator: "!", Operand: e}
+}
+
+//Neg returns the negation '-e'
+func Neg(e Expression) Expression {
+	return UnaryExpression{Operator: "-", Operand: e}
+}
+
+//operation returns the binary operation 'l operator r' of an operator known to be valid
+func operation(operator string, l, r Expression) Expression {
+	return BinaryExpression{Operator: operator, Left: l, Right: r}
+}
+
+//chain combines operands with a left-associative operator, as 'a && b && c'
+func chain(operator string, first Expression, others []Expression) Expression {
+	e := first
+	for _, o := range others {
+		e = operation(operator, e, o)
+	}
+	return e
+}
+
+//And returns the conjunction of expressions, as 'a && b && c'
+func And(first Expression, others ...Expression) Expression { return chain("&&", first, others) }
+
+//Or returns the disjunction of expressions, as 'a || b || c'
+func Or(first Expression, others ...Expression) Expression { return chain("||", first, others) }
+
+//Add returns the sum of expressions, as 'a + b + c'
+func Add(first Expression, others ...Expression) Expression { return chain("+", first, others) }
+
+//Mul returns the product of expressions, as 'a * b * c'
+func Mul(first Expression, others ...Expression) Expression { return chain("*", first, others) }
+
+//Binary returns the binary operation 'l operator r', as 'a &^ b'.
+//It fails when operator is not a binary operator of the language, as '='.
+func Binary(operator string, l, r Expression) (Expression, error) {
+	if precedence(operator) <= precedence("?") {
+		return nil, fmt.Errorf("invalid binary operator '%s'", operator)
+	}
+	return operation(operator, l, r), nil
+}
+
+//Eq returns 'l == r'
+func Eq(l, r Expression) Expression { return operation("==", l, r) }
+
+//Ne returns 'l != r'
+func Ne(l, r Expression) Expression { return operation("!=", l, r) }
+
+//Lt returns 'l < r'
+func Lt(l, r Expression) Expression { return operation("<", l, r) }
+
+//Le returns 'l <= r'
+func Le(l, r Expression) Expression { return operation("<=", l, r) }
+
+//Gt returns 'l > r'
+func Gt(l, r Expression) Expression { return operation(">", l, r) }
+
+//Ge returns 'l >= r'
+func Ge(l, r Expression) Expression { return operation(">=", l, r) }
+
+//In returns 'l in r'
+func In(l, r Expression) Expression { return operation("in", l, r) }
+
+//Sub returns 'l - r'
+func Sub(l, r Expression) Expression { return operation("-", l, r) }
+
+//Div returns 'l / r'
+func Div(l, r Expression) Expression { return operation("/", l, r) }
+
+//Mod returns 'l % r'
+func Mod(l, r Expression) Expression { return operation("%", l, r) }
+
+//Pow returns 'l ** r'
+func Pow(l, r Expression) Expression { return operation("**", l, r) }
+
+//Coalesce returns 'l ?? r'
+func Coalesce(l, r Expression) Expression { return operation("??", l, r) }
+
+//Match returns 'l match pattern'. As with Parse, a string literal pattern is compiled: when it is not a valid
+//regular expression, it is left as a string, for CompileExpression to report it.
+func Match(l, pattern Expression) Expression {
+	if s, ok := pattern.(StringLiteral); ok {
+		if re, err := regexp.Compile(s.Value); err == nil {
+			pattern = PatternLiteral{Regexp: re}
+		}
+	}
+	return operation("match", l, pattern)
+}
+
+//Cond returns the conditional expression 'condition ? yes : no'
+func Cond(condition, yes, no Expression) Expression {
+	return ConditionalExpression{Condition: condition, Yes: yes, No: no}
+}
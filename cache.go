@@ -0,0 +1,59 @@
+package gript
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+//regexpCacheSize is the number of patterns kept compiled by the cache of dynamic patterns
+const regexpCacheSize = 256
+
+//patterns caches the regular expressions compiled from dynamic patterns of 'match', as in "name match pattern"
+var patterns = newRegexpCache(regexpCacheSize)
+
+//regexpCache is a concurrency-safe cache of compiled regular expressions, evicting the least recently used ones
+type regexpCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List //most recently used first
+}
+
+type regexpEntry struct {
+	pattern string
+	re      *regexp.Regexp
+	err     error
+}
+
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+//compile returns the regular expression compiled from a pattern, or the error compiling it
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+
+	c.mutex.Lock()
+	if e, found := c.entries[pattern]; found {
+		c.lru.MoveToFront(e)
+		c.mutex.Unlock()
+		entry := e.Value.(*regexpEntry)
+		return entry.re, entry.err
+	}
+	c.mutex.Unlock()
+
+	//Compile out of the lock, a pattern compiled concurrently being then compiled twice
+	re, err := regexp.Compile(pattern)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.entries[pattern]; !found {
+		c.entries[pattern] = c.lru.PushFront(&regexpEntry{pattern, re, err})
+		if c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*regexpEntry).pattern)
+		}
+	}
+	return re, err
+}
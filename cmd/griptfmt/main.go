@@ -0,0 +1,110 @@
+//Command griptfmt formats gript expressions.
+//
+//Without an explicit path, it formats the standard input. Given a file, it formats the file, holding one expression.
+//By default, griptfmt prints the formatted expressions to the standard output.
+//
+//Usage:
+//
+//	griptfmt [flags] [path ...]
+//
+//The flags are:
+//
+//	-l
+//		Do not print formatted expressions to the standard output.
+//		Instead, print the names of the files whose formatting differs from griptfmt's.
+//	-w
+//		Do not print formatted expressions to the standard output.
+//		Instead, overwrite the files whose formatting differs from griptfmt's.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/xdbsoft/gript"
+)
+
+var (
+	list  = flag.Bool("l", false, "list files whose formatting differs from griptfmt's")
+	write = flag.Bool("w", false, "write result to (source) file instead of stdout")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: griptfmt [flags] [path ...]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "error: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		if err := process("<standard input>", os.Stdin, false); err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			report(err)
+			continue
+		}
+		err = process(path, f, true)
+		f.Close()
+		if err != nil {
+			report(err)
+		}
+	}
+	os.Exit(exitCode)
+}
+
+var exitCode = 0
+
+func report(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 2
+}
+
+//process formats the expression read from r, named filename. Files differing from their formatting are listed
+//with -l and overwritten with -w.
+func process(filename string, r io.Reader, isFile bool) error {
+
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	exp, err := gript.Parse(string(src))
+	if err != nil {
+		if se, ok := err.(*gript.SyntaxError); ok {
+			return fmt.Errorf("%s:%s: %s", filename, se.Span.Start, se.Msg)
+		}
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	res := []byte(gript.Format(exp) + "\n")
+
+	if !bytes.Equal(src, res) {
+		if *list {
+			fmt.Println(filename)
+		}
+		if *write && isFile {
+			if err := ioutil.WriteFile(filename, res, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	if !*list && !*write {
+		_, err = os.Stdout.Write(res)
+	}
+	return err
+}
@@ -0,0 +1,348 @@
+package gript
+
+//opcode is the operation of an instruction of the bytecode run by the vm
+type opcode uint8
+
+const (
+	opConstant       opcode = iota //push constants[a]
+	opVariable                     //push the variable names[a]; when undefined, the error of expressions[b], the top of its path, when b >= 0
+	opMember                       //replace the top value by its member names[a]; when missing, the error of expressions[b] when b >= 0
+	opOptionalMember               //as opMember, but a missing member gives nil and jumps to c, the end of the chain
+	opIndex                        //replace the two top values by the element of the first one at the second one
+	opFunction                     //push the function names[a]
+	opCall                         //replace the function names[b] and its a arguments, on top of it, by the result of the call
+	opList                         //replace the a top values by a list
+	opKey                          //check that the top value can be a key of a map literal
+	opMap                          //replace the 2*a top values, keys and values alternately, by a map
+	opNot                          //replace the top value by the result of the prefix operator
+	opNegate
+	opIdentity
+	opUnary //replace the top value by the result of the prefix operator names[a]
+	opEqual //replace the two top values by the result of the infix operator
+	opNotEqual
+	opLess
+	opLessOrEqual
+	opGreater
+	opGreaterOrEqual
+	opAnd
+	opOr
+	opAdd
+	opSubtract
+	opMultiply
+	opDivide
+	opMatch
+	opBinary      //replace the two top values by the result of the infix operator names[a]
+	opJumpIfFalse //jump to a when the top value is false, keeping it
+	opJumpIfTrue  //jump to a when the top value is true, keeping it
+	opBranch      //pop the condition of a conditional expression, jumping to a when it is false
+	opJump        //jump to a
+	opCoalesce    //end the left part of a '??': jump to a when the top value is not nil, pop it and jump to b otherwise
+	opFallback    //start the right part of a '??', when its left part is undefined
+	opEvaluate    //push the value of expressions[a], an expression not built by the parser
+)
+
+//instruction is an operation and its arguments
+type instruction struct {
+	op      opcode
+	step    bool //the instruction counts an evaluation step before its operation
+	a, b, c int
+}
+
+//handler is the instruction where to resume when the left part of a '??' is undefined,
+//and the size of the stack to restore
+type handler struct {
+	pc     int
+	height int
+}
+
+//bytecode is the compiled form of an expression. The steps and errors of an instruction
+//are located at the span of the same index.
+type bytecode struct {
+	instructions []instruction
+	spans        []Span
+	constants    []interface{}
+	names        []string
+	expressions  []Expression
+	depth        int //maximum size of the stack
+
+	//handlers are the handlers of the instructions of the chains of member and index accesses that are the left part
+	//of a '??': an undefined variable or member they raise gives the right part instead
+	handlers map[int]*handler
+}
+
+//compiler translates an expression tree to bytecode
+type compiler struct {
+	code    bytecode
+	height  int      //current size of the stack
+	handler *handler //handler of the left part of the '??' being compiled, given to the instructions of its chain
+}
+
+//compile translates an expression to the bytecode evaluating it as its Eval method does
+func compile(e Expression) bytecode {
+	//A node gives at most two instructions
+	n := size(e)
+	c := compiler{code: bytecode{instructions: make([]instruction, 0, 2*n), spans: make([]Span, 0, 2*n)}}
+	c.expression(e, false)
+	return c.code
+}
+
+//size returns the number of nodes of an expression tree
+func size(e Expression) int {
+	n := 1
+	switch e := e.(type) {
+	case ListLiteral:
+		for _, item := range e.Items {
+			n += size(item)
+		}
+	case MapLiteral:
+		for _, entry := range e.Entries {
+			n += size(entry.Key) + size(entry.Value)
+		}
+	case MemberExpression:
+		n += size(e.Object)
+	case IndexExpression:
+		n += size(e.Object) + size(e.Index)
+	case CallExpression:
+		for _, arg := range e.Args {
+			n += size(arg)
+		}
+	case UnaryExpression:
+		n += size(e.Operand)
+	case BinaryExpression:
+		n += size(e.Left) + size(e.Right)
+	case ConditionalExpression:
+		n += size(e.Condition) + size(e.Yes) + size(e.No)
+	}
+	return n
+}
+
+//prefixOperators and infixOperators are the opcodes of the operators, the other infix ones being run by opBinary
+var prefixOperators = map[string]opcode{
+	"!": opNot,
+	"-": opNegate,
+	"+": opIdentity,
+}
+
+var infixOperators = map[string]opcode{
+	"==":    opEqual,
+	"!=":    opNotEqual,
+	"<":     opLess,
+	"<=":    opLessOrEqual,
+	">":     opGreater,
+	">=":    opGreaterOrEqual,
+	"&&":    opAnd,
+	"||":    opOr,
+	"+":     opAdd,
+	"-":     opSubtract,
+	"*":     opMultiply,
+	"/":     opDivide,
+	"match": opMatch,
+}
+
+//emit appends an instruction located at span, changing the size of the stack by delta, and returns its index
+func (c *compiler) emit(in instruction, span Span, delta int) int {
+	switch in.op {
+	case opKey, opFunction, opCall, opJumpIfFalse, opJumpIfTrue, opJump, opEvaluate:
+		//No step, or a step counted by the operation itself
+	default:
+		in.step = true
+	}
+	c.code.instructions = append(c.code.instructions, in)
+	c.code.spans = append(c.code.spans, span)
+	c.height += delta
+	if c.height > c.code.depth {
+		c.code.depth = c.height
+	}
+	return len(c.code.instructions) - 1
+}
+
+//chain gives the handler of the '??' being compiled to an instruction of the chain of its left part
+func (c *compiler) chain(i int, chained bool) {
+	if chained {
+		if c.code.handlers == nil {
+			c.code.handlers = map[int]*handler{}
+		}
+		c.code.handlers[i] = c.handler
+	}
+}
+
+//next returns the index of the next instruction, to jump to
+func (c *compiler) next() int {
+	return len(c.code.instructions)
+}
+
+//name returns the index of a name of variable, member, function or operator, the names of an expression being few
+func (c *compiler) name(name string) int {
+	for i, n := range c.code.names {
+		if n == name {
+			return i
+		}
+	}
+	c.code.names = append(c.code.names, name)
+	return len(c.code.names) - 1
+}
+
+func (c *compiler) constant(v interface{}, span Span) {
+	c.code.constants = append(c.code.constants, v)
+	c.emit(instruction{op: opConstant, a: len(c.code.constants) - 1}, span, 1)
+}
+
+//reference keeps an expression the instructions refer to, returning its index
+func (c *compiler) reference(e Expression) int {
+	c.code.expressions = append(c.code.expressions, e)
+	return len(c.code.expressions) - 1
+}
+
+//expression compiles an expression pushing its value, chained being true when it is the left part of a '??'
+func (c *compiler) expression(e Expression, chained bool) {
+
+	switch e := e.(type) {
+	case IntLiteral:
+		c.constant(e.Value, e.span)
+	case FloatLiteral:
+		c.constant(e.Value, e.span)
+	case StringLiteral:
+		c.constant(e.Value, e.span)
+	case PatternLiteral:
+		c.constant(e.Regexp, e.span)
+	case Identifier:
+		c.variable(e, chained, -1)
+	case ListLiteral:
+		for _, item := range e.Items {
+			c.expression(item, false)
+		}
+		c.emit(instruction{op: opList, a: len(e.Items)}, e.span, 1-len(e.Items))
+	case MapLiteral:
+		for _, entry := range e.Entries {
+			c.expression(entry.Key, false)
+			c.emit(instruction{op: opKey}, spanOf(entry.Key), 0)
+			c.expression(entry.Value, false)
+		}
+		c.emit(instruction{op: opMap, a: len(e.Entries)}, e.span, 1-2*len(e.Entries))
+	case MemberExpression, IndexExpression:
+		//An optional access meeting a missing member skips the rest of the chain
+		var skips []int
+		c.access(e, chained, -1, &skips)
+		for _, i := range skips {
+			c.code.instructions[i].c = c.next()
+		}
+	case CallExpression:
+		c.emit(instruction{op: opFunction, a: c.name(e.Function)}, e.span, 1)
+		for _, arg := range e.Args {
+			c.expression(arg, false)
+		}
+		c.emit(instruction{op: opCall, a: len(e.Args), b: c.name(e.Function)}, e.span, -len(e.Args))
+	case UnaryExpression:
+		c.expression(e.Operand, false)
+		if op, ok := prefixOperators[e.Operator]; ok {
+			c.emit(instruction{op: op}, e.span, 0)
+		} else {
+			c.emit(instruction{op: opUnary, a: c.name(e.Operator)}, e.span, 0)
+		}
+	case BinaryExpression:
+		c.binary(e)
+	case ConditionalExpression:
+		c.expression(e.Condition, false)
+		branch := c.emit(instruction{op: opBranch}, e.span, -1)
+		c.expression(e.Yes, false)
+		jump := c.emit(instruction{op: opJump}, e.span, 0)
+		c.code.instructions[branch].a = c.next()
+		c.height--
+		c.expression(e.No, false)
+		c.code.instructions[jump].a = c.next()
+	default:
+		c.emit(instruction{op: opEvaluate, a: c.reference(e)}, spanOf(e), 1)
+	}
+}
+
+//variable compiles a variable, top being the index of the member access at the top of its path, if any
+func (c *compiler) variable(e Identifier, chained bool, top int) {
+	switch e.Name {
+	case "true":
+		c.constant(true, e.span)
+	case "false":
+		c.constant(false, e.span)
+	case "nil":
+		c.constant(nil, e.span)
+	default:
+		c.chain(c.emit(instruction{op: opVariable, a: c.name(e.Name), b: top}, e.span, 1), chained)
+	}
+}
+
+//access compiles a member or an index access of a chain, top being the index of the member access at the top of
+//the path of variable e belongs to, if any: an undefined variable or member of a path reports the whole path.
+//The optional accesses are added to skips, to be given the end of the chain.
+func (c *compiler) access(e Expression, chained bool, top int, skips *[]int) {
+
+	switch e := e.(type) {
+	case MemberExpression:
+		if _, ok := e.path(); !ok {
+			top = -1
+		} else if top < 0 {
+			top = c.reference(e)
+		}
+		c.object(e.Object, chained, top, skips)
+		op := opMember
+		if e.Optional {
+			op = opOptionalMember
+		}
+		i := c.emit(instruction{op: op, a: c.name(e.Name), b: top}, e.span, 0)
+		c.chain(i, chained)
+		if e.Optional {
+			*skips = append(*skips, i)
+		}
+	case IndexExpression:
+		c.object(e.Object, chained, -1, skips)
+		c.expression(e.Index, false)
+		c.chain(c.emit(instruction{op: opIndex}, e.span, -1), chained)
+	}
+}
+
+//object compiles the object of a member or an index access, that continues its chain
+func (c *compiler) object(e Expression, chained bool, top int, skips *[]int) {
+	switch e := e.(type) {
+	case MemberExpression, IndexExpression:
+		c.access(e, chained, top, skips)
+	case Identifier:
+		c.variable(e, chained, top)
+	default:
+		c.expression(e, false)
+	}
+}
+
+func (c *compiler) binary(e BinaryExpression) {
+
+	switch e.Operator {
+	case "??":
+		outer := c.handler
+		c.handler = &handler{height: c.height}
+		c.expression(e.Left, true)
+		coalesce := c.emit(instruction{op: opCoalesce}, e.span, -1)
+		c.handler.pc = c.emit(instruction{op: opFallback}, e.span, 0)
+		c.handler = outer
+		c.code.instructions[coalesce].b = c.next()
+		c.expression(e.Right, false)
+		c.code.instructions[coalesce].a = c.next()
+		return
+	case "&&", "||":
+		//The right part is skipped when the left one is false for '&&', true for '||'
+		op := opJumpIfFalse
+		if e.Operator == "||" {
+			op = opJumpIfTrue
+		}
+		c.expression(e.Left, false)
+		jump := c.emit(instruction{op: op}, e.span, 0)
+		c.expression(e.Right, false)
+		c.emit(instruction{op: infixOperators[e.Operator]}, e.span, -1)
+		c.code.instructions[jump].a = c.next()
+		return
+	}
+
+	c.expression(e.Left, false)
+	c.expression(e.Right, false)
+	if op, ok := infixOperators[e.Operator]; ok {
+		c.emit(instruction{op: op}, e.span, -1)
+	} else {
+		c.emit(instruction{op: opBinary, a: c.name(e.Operator)}, e.span, -1)
+	}
+}
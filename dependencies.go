@@ -0,0 +1,59 @@
+package gript
+
+import "strings"
+
+//Dependency is a variable path or a function referenced by an expression, with the spans of its occurrences in the source
+type Dependency struct {
+	Name  string
+	Spans []Span
+}
+
+//Dependencies are the variables and the functions referenced by an expression, in the order of their first occurrence.
+//
+//Variables are given with the path of the members accessed from them, as 'a.b.c' for 'a.b?.c', the path stopping
+//at an index: 'a.b[0].c' references 'a.b'.
+type Dependencies struct {
+	Variables []Dependency
+	Functions []Dependency
+}
+
+//DependenciesOf returns the variables and the functions referenced by an expression built by Parse
+func DependenciesOf(e Expression) Dependencies {
+	var d Dependencies
+	Inspect(e, func(e Expression) bool {
+		switch e := e.(type) {
+		case Identifier:
+			if !isConstant(e) {
+				d.Variables = add(d.Variables, e.Name, e.span)
+			}
+		case MemberExpression:
+			if p, ok := e.path(); ok {
+				p = strings.Replace(p, "?.", ".", -1)
+				if root := p[:strings.Index(p, ".")]; !isConstant(Identifier{Name: root}) {
+					d.Variables = add(d.Variables, p, e.span)
+				}
+				return false
+			}
+		case CallExpression:
+			d.Functions = add(d.Functions, e.Function, e.span)
+		}
+		return true
+	})
+	return d
+}
+
+//Dependencies returns the variables and the functions referenced by the program, including those of its constant parts
+func (p *Program) Dependencies() Dependencies {
+	return DependenciesOf(p.expression)
+}
+
+//add adds an occurrence of a name to dependencies
+func add(dependencies []Dependency, name string, span Span) []Dependency {
+	for i := range dependencies {
+		if dependencies[i].Name == name {
+			dependencies[i].Spans = append(dependencies[i].Spans, span)
+			return dependencies
+		}
+	}
+	return append(dependencies, Dependency{name, []Span{span}})
+}
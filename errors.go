@@ -0,0 +1,230 @@
+package gript
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+//SyntaxError is returned by Parse when the source of an expression is invalid.
+//
+//Its Error method only gives the message; formatted with the %+v verb, it also gives the position,
+//the expected tokens and the source line with the invalid part underlined:
+//
+// 1:7: invalid expression (expected operand)
+// a &&  || b
+//       ^^
+type SyntaxError struct {
+	Msg      string   //Message describing the error
+	Span     Span     //Location of the invalid part of the source
+	Expected []string //Tokens that would have been valid at this location, if known
+	Source   string   //Source of the expression
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+//Format implements fmt.Formatter: %+v gives the message with the position, the expected tokens
+//and the source line with a caret underline
+func (e *SyntaxError) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if f.Flag('+') {
+			_, _ = io.WriteString(f, e.diagnostic())
+			return
+		}
+		_, _ = io.WriteString(f, e.Error())
+	case 's':
+		_, _ = io.WriteString(f, e.Error())
+	case 'q':
+		_, _ = fmt.Fprintf(f, "%q", e.Error())
+	}
+}
+
+func (e *SyntaxError) diagnostic() string {
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %s", e.Span.Start, e.Msg)
+	if len(e.Expected) > 0 {
+		fmt.Fprintf(&buf, " (expected %s)", strings.Join(e.Expected, " or "))
+	}
+
+	lines := strings.Split(e.Source, "\n")
+	if e.Span.Start.Line < 1 || e.Span.Start.Line > len(lines) {
+		return buf.String()
+	}
+	line := []rune(lines[e.Span.Start.Line-1])
+	buf.WriteString("\n")
+	buf.WriteString(string(line))
+	buf.WriteString("\n")
+
+	//Keep the tabs of the source line so that the caret is aligned
+	start := e.Span.Start.Column - 1
+	for i := 0; i < start && i < len(line); i++ {
+		if line[i] == '\t' {
+			buf.WriteRune('\t')
+		} else {
+			buf.WriteRune(' ')
+		}
+	}
+	width := 1
+	if e.Span.End.Line == e.Span.Start.Line && e.Span.End.Column-1 > start {
+		width = e.Span.End.Column - 1 - start
+	} else if e.Span.End.Line > e.Span.Start.Line && len(line) > start {
+		width = len(line) - start
+	}
+	buf.WriteString(strings.Repeat("^", width))
+	return buf.String()
+}
+
+//located gives its location in the source to an evaluation error.
+//The location is the span of the failing sub-expression, set by the expression raising the error.
+type located struct {
+	Span Span //Location of the failing sub-expression
+}
+
+func (l *located) locate(span Span) {
+	if l.Span == (Span{}) {
+		l.Span = span
+	}
+}
+
+//locate sets the location of an evaluation error, unless it is already set
+func locate(err error, span Span) error {
+	if l, ok := err.(interface{ locate(Span) }); ok {
+		l.locate(span)
+	}
+	return err
+}
+
+//UndefinedVariableError is returned when evaluating a variable missing from the context,
+//or a missing member of such a variable (as in 'a.b')
+type UndefinedVariableError struct {
+	located
+	Name string //Name of the variable, or path of the missing member
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("undefined variable '%s'", e.Name)
+}
+
+//UndefinedFieldError is returned when accessing a missing member of a value that is not a variable
+//(as in 'a[0].b'), or indexing a struct with the name of a missing field
+type UndefinedFieldError struct {
+	located
+	Name string //Name of the missing member
+}
+
+func (e *UndefinedFieldError) Error() string {
+	return fmt.Sprintf("undefined field '%s'", e.Name)
+}
+
+//UndefinedFunctionError is returned when calling a function that is neither provided by the context nor built in
+type UndefinedFunctionError struct {
+	located
+	Name string
+}
+
+func (e *UndefinedFunctionError) Error() string {
+	return fmt.Sprintf("undefined function '%s'", e.Name)
+}
+
+//TypeMismatchError is returned when an operator is applied to operands of unsupported types
+type TypeMismatchError struct {
+	located
+	Operator string         //Operator, as '+' or '!'; '[]' for an index, '{}' for a map literal and '?:' for a conditional
+	Operands []reflect.Type //Types of the operands, a nil type standing for a nil value
+	Msg      string
+}
+
+func (e *TypeMismatchError) Error() string {
+	return e.Msg
+}
+
+//mismatch builds the error reporting operands of unsupported types
+func mismatch(operator, msg string, operands ...interface{}) *TypeMismatchError {
+	types := make([]reflect.Type, len(operands))
+	for i, o := range operands {
+		types[i] = reflect.TypeOf(o)
+	}
+	return &TypeMismatchError{Operator: operator, Operands: types, Msg: msg}
+}
+
+//DivisionByZeroError is returned when dividing an integer by zero, with the operator '/' or '%'.
+//Dividing a float by zero gives an infinity or NaN, unless the expression is evaluated in an Env with StrictFloatDivision.
+type DivisionByZeroError struct {
+	located
+	Operator string
+	Float    bool //Float is true for the division of floats
+}
+
+func (e *DivisionByZeroError) Error() string {
+	if e.Float {
+		return "float division by zero"
+	}
+	return "integer division by zero"
+}
+
+//IndexOutOfRangeError is returned when indexing an array or a slice with a negative or too large index
+type IndexOutOfRangeError struct {
+	located
+	Index  int
+	Length int
+}
+
+func (e *IndexOutOfRangeError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("negative index %d", e.Index)
+	}
+	return fmt.Sprintf("index %d out of range (length %d)", e.Index, e.Length)
+}
+
+//InvalidOperationError is returned when an operator can not be applied to the values of its operands,
+//their types being supported (as a negative shift count or an invalid regular expression)
+type InvalidOperationError struct {
+	located
+	Operator string
+	Msg      string
+}
+
+func (e *InvalidOperationError) Error() string {
+	return e.Msg
+}
+
+//PanicError is returned when the evaluation of an expression panics, as when a host function panics.
+//Value is the value passed to panic.
+type PanicError struct {
+	located
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic during evaluation: %v", e.Value)
+}
+
+//Unwrap returns the value passed to panic, when it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+//FunctionError is returned when calling a host function fails, because the function or its arguments are invalid,
+//or because the function returned an error. In the latter case, Err is the error returned by the function.
+type FunctionError struct {
+	located
+	Name string
+	Msg  string
+	Err  error
+}
+
+func (e *FunctionError) Error() string {
+	return e.Msg
+}
+
+//Unwrap returns the error returned by the function, if any
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
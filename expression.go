@@ -1,36 +1,161 @@
 package gript
 
 import (
-	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"regexp"
 	"strings"
 )
 
-type intExpression int
+//IntLiteral is an integer literal, as 42
+type IntLiteral struct {
+	Value int
+	span  Span
+}
+
+func (e IntLiteral) Span() Span { return e.span }
+
+func (e IntLiteral) Eval(c Context) (interface{}, error) {
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
 
-func (e intExpression) Eval(c Context) (interface{}, error) {
-	return int(e), nil
+//FloatLiteral is a float literal, as 3.14
+type FloatLiteral struct {
+	Value float64
+	span  Span
+}
+
+func (e FloatLiteral) Span() Span { return e.span }
+
+func (e FloatLiteral) Eval(c Context) (interface{}, error) {
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	return e.Value, nil
 }
 
-type floatExpression float64
+//StringLiteral is a string literal, as 'abc', Value being unquoted
+type StringLiteral struct {
+	Value string
+	span  Span
+}
+
+func (e StringLiteral) Span() Span { return e.span }
+
+func (e StringLiteral) Eval(c Context) (interface{}, error) {
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+//ListLiteral is a list literal, as [1, 'a', x]
+type ListLiteral struct {
+	Items []Expression
+	span  Span
+}
+
+func (e ListLiteral) Span() Span { return e.span }
+
+func (e ListLiteral) Eval(c Context) (interface{}, error) {
 
-func (e floatExpression) Eval(c Context) (interface{}, error) {
-	return float64(e), nil
+	l := make([]interface{}, len(e.Items))
+	for i, item := range e.Items {
+		v, err := item.Eval(c)
+		if err != nil {
+			return nil, err
+		}
+		l[i] = v
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	if err := produced(c, l, e.span); err != nil {
+		return nil, err
+	}
+	return l, nil
 }
 
-type stringExpression string
+//MapEntry is a key and its value in a map literal
+type MapEntry struct {
+	Key   Expression
+	Value Expression
+}
 
-func (e stringExpression) Eval(c Context) (interface{}, error) {
-	return string(e), nil
+//MapLiteral is a map literal, as {'a': 1, 'b': x}
+type MapLiteral struct {
+	Entries []MapEntry
+	span    Span
 }
 
-type identExpression string
+func (e MapLiteral) Span() Span { return e.span }
 
-func (e identExpression) Eval(c Context) (interface{}, error) {
+//Eval builds a map[string]interface{} when all keys are strings, like the maps decoded from JSON,
+//and a map[interface{}]interface{} otherwise
+func (e MapLiteral) Eval(c Context) (interface{}, error) {
 
-	switch e {
+	keys := make([]interface{}, len(e.Entries))
+	values := make([]interface{}, len(e.Entries))
+	allStrings := true
+	for i, entry := range e.Entries {
+		k, err := entry.Key.Eval(c)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, locate(mismatch("{}", "unhashable key type in map literal", k), spanOf(entry.Key))
+		}
+		if _, ok := k.(string); !ok {
+			allStrings = false
+		}
+		v, err := entry.Value.Eval(c)
+		if err != nil {
+			return nil, err
+		}
+		keys[i], values[i] = k, v
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+
+	if allStrings {
+		m := make(map[string]interface{}, len(e.Entries))
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		if err := produced(c, m, e.span); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, len(e.Entries))
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	if err := produced(c, m, e.span); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//Identifier is a variable, or one of the constants true, false and nil
+type Identifier struct {
+	Name string
+	span Span
+}
+
+func (e Identifier) Span() Span { return e.span }
+
+func (e Identifier) Eval(c Context) (interface{}, error) {
+
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	switch e.Name {
 	case "true":
 		return true, nil
 	case "false":
@@ -39,28 +164,423 @@ func (e identExpression) Eval(c Context) (interface{}, error) {
 		return nil, nil
 	}
 
-	r, found := c.Value(string(e))
+	r, found := c.Value(e.Name)
+	if !found {
+		return nil, &UndefinedVariableError{located{e.span}, e.Name}
+	}
+	return normalize(r), nil
+}
+
+//isUndefined is true for the errors reporting a missing variable or member
+func isUndefined(err error) bool {
+	switch err.(type) {
+	case *UndefinedVariableError, *UndefinedFieldError:
+		return true
+	}
+	return false
+}
+
+//MemberExpression is the access to a member (a map key or a struct field) of its object, as a.b, or a?.b when Optional
+type MemberExpression struct {
+	Object   Expression
+	Name     string
+	Optional bool
+	span     Span
+}
+
+func (e MemberExpression) Span() Span { return e.span }
+
+//member returns a field of a struct, matching name case insensitively, or the value of a map key.
+//Pointers are dereferenced.
+func member(v interface{}, name string) (interface{}, bool) {
+
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Map:
+		keyType := value.Type().Key()
+		if keyType.Kind() != reflect.String && keyType.Kind() != reflect.Interface {
+			return nil, false
+		}
+		key := reflect.ValueOf(name)
+		if keyType.Kind() == reflect.String {
+			key = key.Convert(keyType)
+		}
+		found := value.MapIndex(key)
+		if !found.IsValid() {
+			return nil, false
+		}
+		return normalize(found.Interface()), true
+	case reflect.Struct:
+		field := fieldByName(value, name)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, false
+		}
+		return normalize(field.Interface()), true
+	}
+	return nil, false
+}
+
+//path returns the variable path of a chain of member accesses from a variable (as 'a.b?.c'),
+//and false if the chain does not start from a variable
+func (e MemberExpression) path() (string, bool) {
+
+	var object string
+	switch o := e.Object.(type) {
+	case Identifier:
+		object = o.Name
+	case MemberExpression:
+		p, ok := o.path()
+		if !ok {
+			return "", false
+		}
+		object = p
+	default:
+		return "", false
+	}
+	if e.Optional {
+		return object + "?." + e.Name, true
+	}
+	return object + "." + e.Name, true
+}
+
+func (e MemberExpression) undefined() error {
+	if p, ok := e.path(); ok {
+		return &UndefinedVariableError{located{e.span}, p}
+	}
+	return &UndefinedFieldError{located{e.span}, e.Name}
+}
+
+//resolve evaluates the member access; skipped is true when an optional access of the chain met a missing value,
+//the rest of the chain then giving nil too, and chained is true when the error is the one of the chain itself,
+//as an undefined variable or member, rather than the one of an index or of an object that is not a chain
+func (e MemberExpression) resolve(c Context) (v interface{}, skipped, chained bool, err error) {
+
+	object, skipped, chained, err := resolve(e.Object, c)
+	if skipped {
+		return nil, true, false, nil
+	}
+	if err != nil {
+		if _, undefined := err.(*UndefinedVariableError); undefined {
+			if _, ok := e.path(); ok {
+				//Report the whole path, as in 'a.b' when 'a' is undefined
+				return nil, false, chained, e.undefined()
+			}
+		}
+		return nil, false, chained, err
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, false, false, err
+	}
+
+	v, found := member(object, e.Name)
+	if !found {
+		if e.Optional {
+			return nil, true, false, nil
+		}
+		return nil, false, true, e.undefined()
+	}
+	if e.Optional {
+		if value := reflect.ValueOf(v); value.Kind() == reflect.Ptr && value.IsNil() {
+			return nil, false, false, nil
+		}
+	}
+	return v, false, false, nil
+}
+
+func (e MemberExpression) Eval(c Context) (interface{}, error) {
+	v, _, _, err := e.resolve(c)
+	return v, err
+}
+
+//ConditionalExpression is a ternary conditional expression, as a ? b : c
+type ConditionalExpression struct {
+	Condition Expression
+	Yes       Expression
+	No        Expression
+	span      Span
+}
+
+func (e ConditionalExpression) Span() Span { return e.span }
+
+//Eval only evaluates the branch selected by the condition
+func (e ConditionalExpression) Eval(c Context) (interface{}, error) {
+
+	v, err := e.Condition.Eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	condition, ok := v.(bool)
+	if !ok {
+		return nil, locate(mismatch("?:", "boolean expected in conditional expression", v), e.span)
+	}
+	if condition {
+		return e.Yes.Eval(c)
+	}
+	return e.No.Eval(c)
+}
+
+//IndexExpression is the access to an element of its object, as a[0] or a['b']
+type IndexExpression struct {
+	Object Expression
+	Index  Expression
+	span   Span
+}
+
+func (e IndexExpression) Span() Span { return e.span }
+
+//fieldByName returns the field of a struct matching a name, case insensitively.
+//A field promoted through a nil embedded pointer is not found.
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	field, found := v.Type().FieldByNameFunc(func(field string) bool {
+		return strings.ToLower(field) == strings.ToLower(name)
+	})
 	if !found {
-		return nil, fmt.Errorf("undefined variable '%s'", e)
+		return reflect.Value{}
+	}
+	for _, i := range field.Index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+//index returns an element of an array or a slice, the value of a map key, or a field of a struct.
+//A key missing from a map gives nil.
+func index(v, i interface{}) (interface{}, error) {
+
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Array, reflect.Slice:
+		n, ok := i.(int)
+		if !ok {
+			return nil, mismatch("[]", "integer expected as index", v, i)
+		}
+		if n < 0 || n >= value.Len() {
+			return nil, &IndexOutOfRangeError{Index: n, Length: value.Len()}
+		}
+		return normalize(value.Index(n).Interface()), nil
+	case reflect.Map:
+		key, err := convertTo(i, value.Type().Key())
+		if err != nil {
+			return nil, mismatch("[]", fmt.Sprintf("invalid key type in index: %s", err), v, i)
+		}
+		if i != nil && !reflect.TypeOf(i).Comparable() {
+			return nil, mismatch("[]", "unhashable key type in index", v, i)
+		}
+		found := value.MapIndex(key)
+		if !found.IsValid() {
+			return nil, nil
+		}
+		return normalize(found.Interface()), nil
+	case reflect.Struct:
+		name, ok := i.(string)
+		if !ok {
+			return nil, mismatch("[]", "string expected as field name", v, i)
+		}
+		field := fieldByName(value, name)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, &UndefinedFieldError{Name: name}
+		}
+		return normalize(field.Interface()), nil
+	}
+	return nil, mismatch("[]", "unsupported type in index", v, i)
+}
+
+//resolve evaluates the index access; skipped is true when an optional access of its object met a missing value,
+//the rest of the chain then giving nil too, and chained is true when the error is the one of the chain itself
+func (e IndexExpression) resolve(c Context) (r interface{}, skipped, chained bool, err error) {
+
+	v, skipped, chained, err := resolve(e.Object, c)
+	if skipped || err != nil {
+		return nil, skipped, chained, err
+	}
+	i, err := e.Index.Eval(c)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, false, false, err
+	}
+	r, err = index(v, i)
+	if err != nil {
+		return nil, false, true, locate(err, e.span)
+	}
+	return r, false, false, nil
+}
+
+func (e IndexExpression) Eval(c Context) (interface{}, error) {
+	r, _, _, err := e.resolve(c)
+	return r, err
+}
+
+//resolve evaluates the object of a member or index access, telling whether an optional access of a chain
+//of member and index accesses met a missing value, and whether the error is the one of the chain itself:
+//the one of its variable or of its accesses, but neither the one of an index nor of an object that is not a chain
+func resolve(e Expression, c Context) (v interface{}, skipped, chained bool, err error) {
+	switch e := e.(type) {
+	case MemberExpression:
+		return e.resolve(c)
+	case IndexExpression:
+		return e.resolve(c)
+	case Identifier:
+		v, err = e.Eval(c)
+		return v, false, true, err
+	}
+	v, err = e.Eval(c)
+	return v, false, false, err
+}
+
+//CallExpression is a call to a function, as max(a, b)
+type CallExpression struct {
+	Function string
+	Args     []Expression
+	span     Span
+}
+
+func (e CallExpression) Span() Span { return e.span }
+
+func (e CallExpression) Eval(c Context) (interface{}, error) {
+
+	fn, found := lookupFunction(c, e.Function)
+	if !found {
+		return nil, &UndefinedFunctionError{located{e.span}, e.Function}
+	}
+
+	args := make([]interface{}, len(e.Args))
+	for i, arg := range e.Args {
+		v, err := arg.Eval(c)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if g := guardOf(c); g != nil {
+		//Host functions are not interrupted: check the cancellation before calling them
+		if err := g.ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+
+	r, err := call(e.Function, fn, args)
+	if err != nil {
+		return nil, locate(err, e.span)
+	}
+	if err := produced(c, r, e.span); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//UnaryExpression is a prefix operator ('!', '-' or '+') applied to its operand, as -a
+type UnaryExpression struct {
+	Operator string
+	Operand  Expression
+	span     Span
+}
+
+func (e UnaryExpression) Span() Span { return e.span }
+
+func not(v interface{}) (interface{}, error) {
+
+	if b, ok := v.(bool); ok {
+		return !b, nil
+	}
+	return nil, mismatch("!", "boolean expected in NOT expression", v)
+}
+
+func negation(v interface{}) (interface{}, error) {
+
+	switch vv := v.(type) {
+	case int:
+		if vv == minInt {
+			//Out of the range of int
+			return -float64(vv), nil
+		}
+		return -vv, nil
+	case float64:
+		return -vv, nil
+	}
+	return nil, mismatch("-", "incompatible type in negation", v)
+}
+
+func identity(v interface{}) (interface{}, error) {
+
+	switch v.(type) {
+	case int, float64:
+		return v, nil
+	}
+	return nil, mismatch("+", "incompatible type in identity", v)
+}
+
+//unary applies a prefix operator to the value of its operand
+func unary(operator string, v interface{}) (interface{}, error) {
+
+	switch operator {
+	case "!":
+		return not(v)
+	case "-":
+		return negation(v)
+	case "+":
+		return identity(v)
+	}
+	return nil, &InvalidOperationError{Operator: operator, Msg: fmt.Sprintf("Unsupported operator '%s'", operator)}
+}
+
+func (e UnaryExpression) Eval(c Context) (interface{}, error) {
+
+	v, err := e.Operand.Eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+
+	r, err := unary(e.Operator, v)
+	if err != nil {
+		return nil, locate(err, e.span)
 	}
 	return r, nil
 }
 
-type binaryExpression struct {
-	operator string
-	left     Expression
-	right    Expression
+//BinaryExpression is an infix operator applied to its operands, as a + b
+type BinaryExpression struct {
+	Operator string
+	Left     Expression
+	Right    Expression
+	span     Span
 }
 
+func (e BinaryExpression) Span() Span { return e.span }
+
 func or(l, r interface{}) (bool, error) {
 
 	vl, ok := l.(bool)
 	if !ok {
-		return false, errors.New("boolean expected in OR expression")
+		return false, mismatch("||", "boolean expected in OR expression", l, r)
 	}
 	vr, ok := r.(bool)
 	if !ok {
-		return false, errors.New("boolean expected in OR expression")
+		return false, mismatch("||", "boolean expected in OR expression", l, r)
 	}
 	return vl || vr, nil
 }
@@ -68,36 +588,163 @@ func and(l, r interface{}) (bool, error) {
 
 	vl, ok := l.(bool)
 	if !ok {
-		return false, errors.New("boolean expected in AND expression")
+		return false, mismatch("&&", "boolean expected in AND expression", l, r)
 	}
 	vr, ok := r.(bool)
 	if !ok {
-		return false, errors.New("boolean expected in AND expression")
+		return false, mismatch("&&", "boolean expected in AND expression", l, r)
 	}
 	return vl && vr, nil
 }
 
-func less(l, r interface{}) (bool, error) {
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+//normalize converts the values of any Go integer or float type, as provided by the host, to int or float64,
+//and the values of named string or bool types to string or bool: the only types handled by the operators.
+//Integers out of the range of int are converted to float64.
+func normalize(v interface{}) interface{} {
+
+	switch v.(type) {
+	case nil, int, float64, string, bool:
+		return v
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := value.Int()
+		if i < int64(minInt) || i > int64(maxInt) {
+			return float64(i)
+		}
+		return int(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := value.Uint()
+		if u > uint64(maxInt) {
+			return float64(u)
+		}
+		return int(u)
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	case reflect.Bool:
+		return value.Bool()
+	}
+	return v
+}
+
+//promote converts an int operand to float64 when the other operand is a float64
+func promote(l, r interface{}) (interface{}, interface{}) {
 
 	switch vl := l.(type) {
 	case int:
+		if vr, ok := r.(float64); ok {
+			return float64(vl), vr
+		}
+	case float64:
 		if vr, ok := r.(int); ok {
-			return vl < vr, nil
+			return vl, float64(vr)
+		}
+	}
+	return l, r
+}
+
+//equal compares two values, numbers being promoted as in arithmetic.
+//Arrays, slices and maps are compared element by element.
+func equal(l, r interface{}) bool {
+
+	l, r = promote(normalize(l), normalize(r))
+	if l == nil || r == nil {
+		return l == r
+	}
+
+	lValue := reflect.ValueOf(l)
+	rValue := reflect.ValueOf(r)
+	switch {
+	case isList(lValue) && isList(rValue):
+		if lValue.Len() != rValue.Len() {
+			return false
+		}
+		for i := 0; i < lValue.Len(); i++ {
+			if !equal(lValue.Index(i).Interface(), rValue.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	case lValue.Kind() == reflect.Map && rValue.Kind() == reflect.Map:
+		if lValue.Len() != rValue.Len() {
+			return false
+		}
+		for _, k := range lValue.MapKeys() {
+			rk, err := convertTo(k.Interface(), rValue.Type().Key())
+			if err != nil {
+				return false
+			}
+			rv := rValue.MapIndex(rk)
+			if !rv.IsValid() || !equal(lValue.MapIndex(k).Interface(), rv.Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !lValue.Type().Comparable() || !rValue.Type().Comparable() {
+		return reflect.DeepEqual(l, r)
+	}
+	return l == r
+}
+
+func isList(v reflect.Value) bool {
+	return v.Kind() == reflect.Array || v.Kind() == reflect.Slice
+}
+
+//less reports whether l is lower than r, ok being false when the values are not ordered
+func less(l, r interface{}) (result bool, ok bool) {
+
+	l, r = promote(l, r)
+	switch vl := l.(type) {
+	case int:
+		if vr, ok := r.(int); ok {
+			return vl < vr, true
 		}
 	case float64:
 		if vr, ok := r.(float64); ok {
-			return vl < vr, nil
+			return vl < vr, true
 		}
 	case string:
 		if vr, ok := r.(string); ok {
-			return vl < vr, nil
+			return vl < vr, true
+		}
+	}
+	return false, false
+}
+
+//compare applies one of the ordering operators <, <=, > and >=
+func compare(operator string, l, r interface{}) (interface{}, error) {
+
+	if operator == "<=" || operator == ">=" {
+		if equal(l, r) {
+			return true, nil
 		}
 	}
-	return false, errors.New("incompatible types in comparison")
+	var result, ok bool
+	if operator == "<" || operator == "<=" {
+		result, ok = less(l, r)
+	} else {
+		result, ok = less(r, l)
+	}
+	if !ok {
+		return nil, mismatch(operator, "incompatible types in comparison", l, r)
+	}
+	return result, nil
 }
 
 func sum(l, r interface{}) (interface{}, error) {
 
+	l, r = promote(l, r)
 	switch vl := l.(type) {
 	case int:
 		if vr, ok := r.(int); ok {
@@ -112,10 +759,11 @@ func sum(l, r interface{}) (interface{}, error) {
 			return vl + vr, nil
 		}
 	}
-	return nil, errors.New("incompatible types in sum")
+	return nil, mismatch("+", "incompatible types in sum", l, r)
 }
 func difference(l, r interface{}) (interface{}, error) {
 
+	l, r = promote(l, r)
 	switch vl := l.(type) {
 	case int:
 		if vr, ok := r.(int); ok {
@@ -126,9 +774,10 @@ func difference(l, r interface{}) (interface{}, error) {
 			return vl - vr, nil
 		}
 	}
-	return nil, errors.New("incompatible types in difference")
+	return nil, mismatch("-", "incompatible types in difference", l, r)
 }
 func product(l, r interface{}) (interface{}, error) {
+	l, r = promote(l, r)
 	switch vl := l.(type) {
 	case int:
 		if vr, ok := r.(int); ok {
@@ -139,13 +788,17 @@ func product(l, r interface{}) (interface{}, error) {
 			return vl * vr, nil
 		}
 	}
-	return nil, errors.New("incompatible types in product")
+	return nil, mismatch("*", "incompatible types in product", l, r)
 }
 func quotient(l, r interface{}) (interface{}, error) {
 
+	l, r = promote(l, r)
 	switch vl := l.(type) {
 	case int:
 		if vr, ok := r.(int); ok {
+			if vr == 0 {
+				return nil, &DivisionByZeroError{Operator: "/"}
+			}
 			return vl / vr, nil
 		}
 	case float64:
@@ -153,105 +806,263 @@ func quotient(l, r interface{}) (interface{}, error) {
 			return vl / vr, nil
 		}
 	}
-	return nil, errors.New("incompatible types in quotient")
+	return nil, mismatch("/", "incompatible types in quotient", l, r)
 }
+
+//isFloatDivisionByZero is true when dividing by a float zero, or dividing a float by zero.
+//Such a division gives an infinity or NaN, as specified by IEEE 754.
+func isFloatDivisionByZero(l, r interface{}) bool {
+	vl, vr := promote(l, r)
+	if _, ok := vl.(float64); !ok {
+		return false
+	}
+	f, ok := vr.(float64)
+	return ok && f == 0
+}
+
 func modulo(l, r interface{}) (interface{}, error) {
 
 	switch vl := l.(type) {
 	case int:
 		if vr, ok := r.(int); ok {
+			if vr == 0 {
+				return nil, &DivisionByZeroError{Operator: "%"}
+			}
 			return vl % vr, nil
 		}
 	}
-	return nil, errors.New("incompatible types in modulo")
+	return nil, mismatch("%", "incompatible types in modulo", l, r)
+}
+
+//power raises l to the power r: integer power for an int raised to a non-negative int, unless it overflows,
+//math.Pow otherwise
+func power(l, r interface{}) (interface{}, error) {
+
+	l, r = promote(l, r)
+	switch vl := l.(type) {
+	case int:
+		if vr, ok := r.(int); ok {
+			if vr >= 0 {
+				if result, ok := intPower(vl, vr); ok {
+					return result, nil
+				}
+			}
+			return math.Pow(float64(vl), float64(vr)), nil
+		}
+	case float64:
+		if vr, ok := r.(float64); ok {
+			return math.Pow(vl, vr), nil
+		}
+	}
+	return nil, mismatch("**", "incompatible types in power", l, r)
+}
+
+//intPower raises an int to a non-negative int power by squaring, ok being false when it overflows
+func intPower(base, exponent int) (result int, ok bool) {
+	result = 1
+	for {
+		if exponent&1 == 1 {
+			if result, ok = multiply(result, base); !ok {
+				return 0, false
+			}
+		}
+		exponent >>= 1
+		if exponent == 0 {
+			return result, true
+		}
+		if base, ok = multiply(base, base); !ok {
+			return 0, false
+		}
+	}
+}
+
+//multiply returns the product of two ints, ok being false when it overflows
+func multiply(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	p := a * b
+	if p/b != a || (a == minInt && b == -1) {
+		return 0, false
+	}
+	return p, true
+}
+
+//bitwise applies a bitwise or a shift operator to integers
+func bitwise(operator string, l, r interface{}) (interface{}, error) {
+
+	vl, okl := l.(int)
+	vr, okr := r.(int)
+	if !okl || !okr {
+		return nil, mismatch(operator, fmt.Sprintf("integers expected in operator %s", operator), l, r)
+	}
+
+	switch operator {
+	case "&":
+		return vl & vr, nil
+	case "|":
+		return vl | vr, nil
+	case "^":
+		return vl ^ vr, nil
+	case "&^":
+		return vl &^ vr, nil
+	}
+
+	if vr < 0 {
+		return nil, &InvalidOperationError{Operator: operator, Msg: fmt.Sprintf("negative shift count %d", vr)}
+	}
+	if operator == "<<" {
+		return vl << uint(vr), nil
+	}
+	return vl >> uint(vr), nil
 }
 
 func in(l, r interface{}) (interface{}, error) {
 
 	rValue := reflect.ValueOf(r)
-	lValue := reflect.ValueOf(l)
 
 	switch rValue.Kind() {
 	case reflect.Array, reflect.Slice:
-		if !lValue.Type().AssignableTo(rValue.Type().Elem()) {
-			return nil, errors.New("invalid type in operator in")
+		lValue, err := convertTo(l, rValue.Type().Elem())
+		if err != nil {
+			return nil, mismatch("in", "invalid type in operator in", l, r)
 		}
 		for i := 0; i < rValue.Len(); i++ {
-			if rValue.Index(i).Interface() == lValue.Interface() {
+			if equal(rValue.Index(i).Interface(), lValue.Interface()) {
 				return true, nil
 			}
 		}
 		return false, nil
 	case reflect.Map:
-		if !lValue.Type().AssignableTo(rValue.Type().Key()) {
-			return nil, errors.New("invalid key type in operator in")
+		lValue, err := convertTo(l, rValue.Type().Key())
+		if err != nil {
+			return nil, mismatch("in", "invalid key type in operator in", l, r)
+		}
+		if l != nil && !reflect.TypeOf(l).Comparable() {
+			return nil, mismatch("in", "unhashable key type in operator in", l, r)
 		}
 		return rValue.MapIndex(lValue).IsValid(), nil
 	case reflect.Struct:
-		found := rValue.FieldByNameFunc(func(name string) bool {
-			return strings.ToLower(name) == strings.ToLower(lValue.String())
-		})
+		name, ok := l.(string)
+		if !ok {
+			return nil, mismatch("in", "invalid type in operator in", l, r)
+		}
+		found := fieldByName(rValue, name)
 		return found.IsValid(), nil
 	}
-	return nil, errors.New("unsupported types in operator in")
+	return nil, mismatch("in", "unsupported types in operator in", l, r)
+}
+
+//PatternLiteral is a regular expression compiled from a string literal, as in "name match '^a'"
+type PatternLiteral struct {
+	Regexp *regexp.Regexp
+	span   Span
+}
+
+func (e PatternLiteral) Span() Span { return e.span }
+
+func (e PatternLiteral) Eval(c Context) (interface{}, error) {
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
+	return e.Regexp, nil
 }
 
+//match reports whether a string matches a regular expression, given as a string or already compiled.
+//The patterns given as strings are compiled through a cache.
 func match(l, r interface{}) (interface{}, error) {
 
 	vl, okl := l.(string)
+	if re, ok := r.(*regexp.Regexp); okl && ok {
+		return re.MatchString(vl), nil
+	}
 	vr, okr := r.(string)
 
 	if okl && okr {
-		return regexp.MatchString(vr, vl)
+		re, err := patterns.compile(vr)
+		if err != nil {
+			return nil, &InvalidOperationError{Operator: "match", Msg: err.Error()}
+		}
+		return re.MatchString(vl), nil
 	}
 
-	return nil, errors.New("unsupported types in operator match")
+	return nil, mismatch("match", "unsupported types in operator match", l, r)
 }
 
-func (e binaryExpression) Eval(c Context) (interface{}, error) {
+func (e BinaryExpression) Eval(c Context) (interface{}, error) {
 
-	l, err := e.left.Eval(c)
+	if e.Operator == "??" {
+		//Null-coalescing: the right part is only evaluated when the left one is nil, or is a variable or a chain
+		//of member and index accesses that is undefined (an undefined name within an index or an operand is an error)
+		l, _, chained, err := resolve(e.Left, c)
+		if err != nil && !(chained && isUndefined(err)) {
+			return nil, err
+		}
+		if err := step(c, e.span); err != nil {
+			return nil, err
+		}
+		if err == nil && l != nil {
+			return l, nil
+		}
+		return e.Right.Eval(c)
+	}
+	l, err := e.Left.Eval(c)
 	if err != nil {
 		return nil, err
 	}
 
 	//Fast exit: in some cases, no need to compute right part of the expression
-	switch e.operator {
-	case "&&":
-		vl, ok := l.(bool)
-		if ok && !vl {
-			return false, nil
-		}
-	case "||":
-		vl, ok := l.(bool)
-		if ok && vl {
-			return true, nil
+	switch e.Operator {
+	case "&&", "||":
+		if vl, ok := l.(bool); ok && vl == (e.Operator == "||") {
+			if err := step(c, e.span); err != nil {
+				return nil, err
+			}
+			return vl, nil
 		}
 	}
-	r, err := e.right.Eval(c)
+	r, err := e.Right.Eval(c)
 	if err != nil {
 		return nil, err
 	}
+	if err := step(c, e.span); err != nil {
+		return nil, err
+	}
 
-	switch e.operator {
-	case "==":
-		return l == r, nil
-	case "!=":
-		return l != r, nil
-	case ">":
-		return less(r, l)
-	case ">=":
-		if l == r {
-			return true, nil
+	if e.Operator == "/" && isStrictFloatDivision(c) && isFloatDivisionByZero(l, r) {
+		return nil, &DivisionByZeroError{located{e.span}, e.Operator, true}
+	}
+
+	if e.Operator == "match" {
+		if g := guardOf(c); g != nil {
+			if err := g.matched(l); err != nil {
+				return nil, locate(err, e.span)
+			}
 		}
-		return less(r, l)
-	case "<":
-		return less(l, r)
-	case "<=":
-		if l == r {
-			return true, nil
+	}
+
+	v, err := binary(e.Operator, l, r)
+	if err != nil {
+		return nil, locate(err, e.span)
+	}
+	if e.Operator == "+" {
+		if err := produced(c, v, e.span); err != nil {
+			return nil, err
 		}
-		return less(l, r)
+	}
+	return v, nil
+}
+
+//binary applies an infix operator to the values of its operands
+func binary(operator string, l, r interface{}) (interface{}, error) {
+
+	switch operator {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		return compare(operator, l, r)
 	case "||":
 		return or(l, r)
 	case "&&":
@@ -266,10 +1077,14 @@ func (e binaryExpression) Eval(c Context) (interface{}, error) {
 		return quotient(l, r)
 	case "%":
 		return modulo(l, r)
+	case "**":
+		return power(l, r)
+	case "&", "|", "^", "&^", "<<", ">>":
+		return bitwise(operator, l, r)
 	case "in":
 		return in(l, r)
 	case "match":
 		return match(l, r)
 	}
-	return nil, fmt.Errorf("Unsupported operator '%s'", e.operator)
+	return nil, &InvalidOperationError{Operator: operator, Msg: fmt.Sprintf("Unsupported operator '%s'", operator)}
 }
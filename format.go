@@ -0,0 +1,216 @@
+package gript
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//Format renders an expression tree as canonical source: single spaces around binary operators and after commas,
+//strings within single quotes (double quotes when they contain single quotes only), and only the parentheses required
+//by the precedence of the operators.
+//For a tree built by Parse, Parse(Format(e)) builds the same tree.
+func Format(e Expression) string {
+	var b strings.Builder
+	format(&b, e)
+	return b.String()
+}
+
+func (e IntLiteral) String() string            { return Format(e) }
+func (e FloatLiteral) String() string          { return Format(e) }
+func (e StringLiteral) String() string         { return Format(e) }
+func (e PatternLiteral) String() string        { return Format(e) }
+func (e Identifier) String() string            { return Format(e) }
+func (e ListLiteral) String() string           { return Format(e) }
+func (e MapLiteral) String() string            { return Format(e) }
+func (e MemberExpression) String() string      { return Format(e) }
+func (e IndexExpression) String() string       { return Format(e) }
+func (e CallExpression) String() string        { return Format(e) }
+func (e UnaryExpression) String() string       { return Format(e) }
+func (e BinaryExpression) String() string      { return Format(e) }
+func (e ConditionalExpression) String() string { return Format(e) }
+
+//postfixPrecedence is the precedence of the operands and of the member, index and call expressions,
+//tighter than any operator
+const postfixPrecedence = 11
+
+//precedenceOf returns the precedence of the operator of an expression
+func precedenceOf(e Expression) int {
+	switch e := e.(type) {
+	case IntLiteral:
+		if e.Value < 0 {
+			return unaryPrecedence
+		}
+	case FloatLiteral:
+		if math.Signbit(e.Value) && !math.IsInf(e.Value, -1) {
+			return unaryPrecedence
+		}
+	case UnaryExpression:
+		return unaryPrecedence
+	case BinaryExpression:
+		return precedence(e.Operator)
+	case ConditionalExpression:
+		return precedence("?:")
+	}
+	return postfixPrecedence
+}
+
+//operand renders an expression, within parentheses when its precedence is lower than min
+func operand(b *strings.Builder, e Expression, min int) {
+	if precedenceOf(e) < min {
+		b.WriteByte('(')
+		format(b, e)
+		b.WriteByte(')')
+		return
+	}
+	format(b, e)
+}
+
+//formatFloat renders a float so that it is scanned as a float, with an exponent when it is very small or very large,
+//infinities and NaN being rendered as divisions
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "(1.0 / 0.0)"
+	case math.IsInf(f, -1):
+		return "(-1.0 / 0.0)"
+	case math.IsNaN(f):
+		return "(0.0 / 0.0)"
+	}
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-4 || abs >= 1e21) {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+//quote renders a string literal within single quotes, or within double quotes when it contains single quotes only,
+//escaping the quote, the backslash and the non-printable characters
+func quote(s string) string {
+
+	q := byte('\'')
+	if strings.Contains(s, "'") && !strings.Contains(s, "\"") {
+		q = '"'
+	}
+
+	b := []byte{q}
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b = append(b, fmt.Sprintf(`\x%02x`, s[i])...)
+		case r == rune(q) || r == '\\':
+			b = append(b, '\\', byte(r))
+		case strconv.IsPrint(r):
+			b = append(b, s[i:i+size]...)
+		default:
+			//The escape sequence of the character, as Go quotes it
+			escaped := strconv.QuoteRune(r)
+			b = append(b, escaped[1:len(escaped)-1]...)
+		}
+		i += size
+	}
+	return string(append(b, q))
+}
+
+func format(b *strings.Builder, e Expression) {
+	switch e := e.(type) {
+	case IntLiteral:
+		b.WriteString(strconv.Itoa(e.Value))
+	case FloatLiteral:
+		b.WriteString(formatFloat(e.Value))
+	case StringLiteral:
+		b.WriteString(quote(e.Value))
+	case PatternLiteral:
+		b.WriteString(quote(e.Regexp.String()))
+	case Identifier:
+		b.WriteString(e.Name)
+	case ListLiteral:
+		b.WriteByte('[')
+		for i, item := range e.Items {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, item)
+		}
+		b.WriteByte(']')
+	case MapLiteral:
+		b.WriteByte('{')
+		for i, entry := range e.Entries {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			operand(b, entry.Key, precedence("?:")+1)
+			b.WriteString(": ")
+			format(b, entry.Value)
+		}
+		b.WriteByte('}')
+	case MemberExpression:
+		object(b, e.Object)
+		if e.Optional {
+			b.WriteString("?.")
+		} else {
+			b.WriteByte('.')
+		}
+		b.WriteString(e.Name)
+	case IndexExpression:
+		object(b, e.Object)
+		b.WriteByte('[')
+		format(b, e.Index)
+		b.WriteByte(']')
+	case CallExpression:
+		b.WriteString(e.Function)
+		b.WriteByte('(')
+		for i, arg := range e.Args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, arg)
+		}
+		b.WriteByte(')')
+	case UnaryExpression:
+		b.WriteString(e.Operator)
+		operand(b, e.Operand, unaryPrecedence)
+	case BinaryExpression:
+		p := precedence(e.Operator)
+		left, right := p, p+1
+		if isRightAssociative(e.Operator) {
+			left, right = p+1, p
+		}
+		if e.Operator == "**" {
+			//The right operand of a power is parsed as a prefix expression: '2 ** -1' is '2 ** (-1)'
+			right = unaryPrecedence
+		}
+		operand(b, e.Left, left)
+		b.WriteByte(' ')
+		b.WriteString(e.Operator)
+		b.WriteByte(' ')
+		operand(b, e.Right, right)
+	case ConditionalExpression:
+		p := precedence("?:")
+		operand(b, e.Condition, p+1)
+		b.WriteString(" ? ")
+		operand(b, e.Yes, p+1)
+		b.WriteString(" : ")
+		operand(b, e.No, p)
+	default:
+		fmt.Fprint(b, e)
+	}
+}
+
+//object renders the object of a member or an index expression, numbers being within parentheses as in '(1).a'
+func object(b *strings.Builder, e Expression) {
+	switch e.(type) {
+	case IntLiteral, FloatLiteral:
+		if s := Format(e); !strings.HasPrefix(s, "(") {
+			b.WriteString("(" + s + ")")
+			return
+		}
+	}
+	operand(b, e, postfixPrecedence)
+}
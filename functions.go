@@ -0,0 +1,218 @@
+package gript
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+//Functions is a registry of host functions that can be called by name from an expression, as in 'lower(name)'.
+//
+//Any Go function can be registered. On each call, the number of arguments is checked and each argument
+//is converted to the type of the matching parameter; numbers are converted between int and float types as long
+//as no precision is lost, and strings and booleans to named string and bool types. A function must return a single value, or a value and an error.
+type Functions map[string]interface{}
+
+//FunctionContext is a Context that also provides the functions that can be called from an expression
+type FunctionContext interface {
+	Context
+	Function(name string) (fn interface{}, found bool)
+}
+
+//Env binds a Context to the functions that can be called from the expressions evaluated against it
+type Env struct {
+	Context
+	Functions Functions
+
+	//StrictFloatDivision makes a division of floats by zero fail with a *DivisionByZeroError,
+	//instead of giving an infinity or NaN
+	StrictFloatDivision bool
+}
+
+func (e Env) strictFloatDivision() bool {
+	return e.StrictFloatDivision
+}
+
+//isStrictFloatDivision is true when the context requires a division of floats by zero to fail
+func isStrictFloatDivision(c Context) bool {
+	s, ok := c.(interface{ strictFloatDivision() bool })
+	return ok && s.strictFloatDivision()
+}
+
+//Function returns the function registered with the given name
+func (e Env) Function(name string) (interface{}, bool) {
+	fn, found := e.Functions[name]
+	return fn, found
+}
+
+//builtins are the functions available to every expression, unless shadowed by a host function with the same name
+var builtins = Functions{
+	"len":   length,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+//length returns the number of characters of a string, or the number of elements of an array, a slice or a map
+func length(v interface{}) (int, error) {
+
+	if s, ok := v.(string); ok {
+		return utf8.RuneCountInString(s), nil
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return value.Len(), nil
+	}
+	return 0, errors.New("string, array, slice or map expected")
+}
+
+func lookupFunction(c Context, name string) (interface{}, bool) {
+
+	if fc, ok := c.(FunctionContext); ok {
+		if fn, found := fc.Function(name); found {
+			return fn, true
+		}
+	}
+	fn, found := builtins[name]
+	return fn, found
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func isNumberKind(k reflect.Kind) bool {
+
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isUnsignedKind(k reflect.Kind) bool {
+
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+//isNegative is true for the ints and floats lower than zero
+func isNegative(v reflect.Value) bool {
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() < 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() < 0
+	}
+	return false
+}
+
+func isNillableKind(k reflect.Kind) bool {
+
+	switch k {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+//convertTo converts a value to the given type, like the value of an argument to the type of the parameter receiving it
+func convertTo(a interface{}, t reflect.Type) (reflect.Value, error) {
+
+	if a == nil {
+		if isNillableKind(t.Kind()) {
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", t)
+	}
+
+	v := reflect.ValueOf(a)
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	if isNumberKind(v.Kind()) && isNumberKind(t.Kind()) {
+		if isUnsignedKind(t.Kind()) && isNegative(v) {
+			//The conversion wraps around, and converting back gives the same value
+			return reflect.Value{}, fmt.Errorf("cannot use negative value %v as %s", a, t)
+		}
+		converted := v.Convert(t)
+		if converted.Convert(v.Type()).Interface() != a {
+			return reflect.Value{}, fmt.Errorf("cannot use %v as %s without loss of precision", a, t)
+		}
+		return converted, nil
+	}
+	if (v.Kind() == reflect.String || v.Kind() == reflect.Bool) && v.Kind() == t.Kind() {
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", v.Type(), t)
+}
+
+//call invokes a host function with already evaluated arguments
+func call(name string, fn interface{}, args []interface{}) (interface{}, error) {
+
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return nil, failure(name, nil, "'%s' is not a function", name)
+	}
+	ft := fv.Type()
+
+	if ft.NumOut() != 1 && (ft.NumOut() != 2 || ft.Out(1) != errorType) {
+		return nil, failure(name, nil, "function '%s' must return a value, or a value and an error", name)
+	}
+
+	n := ft.NumIn()
+	if ft.IsVariadic() {
+		if len(args) < n-1 {
+			return nil, failure(name, nil, "function '%s' expects at least %d arguments, got %d", name, n-1, len(args))
+		}
+	} else if len(args) != n {
+		return nil, failure(name, nil, "function '%s' expects %d arguments, got %d", name, n, len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var t reflect.Type
+		if ft.IsVariadic() && i >= n-1 {
+			t = ft.In(n - 1).Elem()
+		} else {
+			t = ft.In(i)
+		}
+		v, err := convertTo(a, t)
+		if err != nil {
+			return nil, failure(name, nil, "function '%s': argument %d: %s", name, i+1, err)
+		}
+		in[i] = v
+	}
+
+	out, err := invoke(fv, in)
+	if err != nil {
+		return nil, failure(name, err, "function '%s': %s", name, err)
+	}
+	if len(out) == 2 && !out[1].IsNil() {
+		err := out[1].Interface().(error)
+		return nil, failure(name, err, "function '%s': %s", name, err)
+	}
+	return normalize(out[0].Interface()), nil
+}
+
+//invoke calls a function, turning a panic into a *PanicError
+func invoke(fv reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v}
+		}
+	}()
+	return fv.Call(in), nil
+}
+
+//failure builds the error reporting a failed call to a host function, err being the error returned by the function
+func failure(name string, err error, format string, a ...interface{}) *FunctionError {
+	return &FunctionError{Name: name, Msg: fmt.Sprintf(format, a...), Err: err}
+}
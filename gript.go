@@ -2,21 +2,25 @@ package gript
 
 import (
 	"bytes"
-	"reflect"
-	"strings"
+	"context"
 )
 
-//Context is an interface allowing access to variable values
+//Context is an interface allowing access to variable values.
+//
+//Only variable names are looked up in the context: member access, as in 'a.b',
+//is resolved by the expression on the value of the variable.
 type Context interface {
 	Value(identifier string) (value interface{}, found bool)
 }
 
-//Expression (boolean, numerical, ...) is an obect that can be evaluated against a context
+//Expression (boolean, numerical, ...) is an obect that can be evaluated against a context.
+//The expressions built by Parse are trees of nodes, as BinaryExpression, Identifier or IntLiteral.
 type Expression interface {
 	Eval(c Context) (interface{}, error)
 }
 
-//Parse parses a string to create an expression
+//Parse parses a string to create an expression.
+//When the string is invalid, the returned error is a *SyntaxError.
 //
 //Examples
 // a < 2
@@ -25,56 +29,60 @@ func Parse(s string) (Expression, error) {
 	b := bytes.NewBufferString(s)
 
 	parser := newParser(b)
-	return parser.Parse()
+	exp, err := parser.Parse()
+	if err, ok := err.(*SyntaxError); ok {
+		err.Source = s
+		return nil, err
+	}
+	return exp, err
 }
 
-//Eval evaluates a string representing an expression against a set of variables
-func Eval(s string, values map[string]interface{}) (interface{}, error) {
-	vm := vm{values}
-	return vm.Eval(s)
+//Evaluate evaluates an expression against a context, returning a *PanicError
+//instead of panicking when the evaluation panics
+func Evaluate(e Expression, c Context) (v interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			v, err = nil, &PanicError{Value: p}
+		}
+	}()
+	return e.Eval(c)
 }
 
-type vm struct {
-	values map[string]interface{}
+//Eval evaluates a string representing an expression against a set of variables.
+//The string is parsed on each call: use Compile for an expression evaluated many times.
+func Eval(s string, values map[string]interface{}) (interface{}, error) {
+	p, err := Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	return p.Eval(values)
 }
 
-func (vm *vm) Value(ident string) (interface{}, bool) {
-
-	parts := strings.Split(ident, ".")
-	var current interface{}
-	current = vm.values
-
-	for i := 0; i < len(parts); i++ {
-
-		if currentMap, ok := current.(map[string]interface{}); ok {
-			next, found := currentMap[parts[i]]
-			if !found {
-				return nil, false
-			}
-			current = next
-		} else {
-			currentValue := reflect.ValueOf(current)
-			if currentValue.Kind() != reflect.Struct {
-				return nil, false
-			}
-			nextValue := currentValue.FieldByNameFunc(func(name string) bool {
-				return strings.ToLower(name) == strings.ToLower(parts[i])
-			})
-			if (nextValue == reflect.Value{}) {
-				return nil, false
-			}
-			current = nextValue.Interface()
-		}
+//EvalWithFunctions evaluates a string representing an expression against a set of variables,
+//the expression being allowed to call the given functions
+func EvalWithFunctions(s string, values map[string]interface{}, functions Functions) (interface{}, error) {
+	p, err := Compile(s, WithFunctions(functions))
+	if err != nil {
+		return nil, err
 	}
-
-	return current, true
+	return p.Eval(values)
 }
 
-func (vm *vm) Eval(s string) (interface{}, error) {
-
-	exp, err := Parse(s)
+//EvalContext evaluates a string representing an expression against a set of variables, compiling it
+//with the given options, as Compile does. The evaluation stops with the error of ctx when ctx is cancelled
+//or its deadline expires.
+func EvalContext(ctx context.Context, s string, values map[string]interface{}, opts ...Option) (interface{}, error) {
+	p, err := Compile(s, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return exp.Eval(vm)
+	return p.RunContext(ctx, variables(values))
+}
+
+//variables is a Context giving the values of a map
+type variables map[string]interface{}
+
+func (v variables) Value(name string) (interface{}, bool) {
+	value, found := v[name]
+	return value, found
 }
@@ -1,6 +1,16 @@
 package gript
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
 
 type testCase struct {
 	expression string
@@ -8,17 +18,43 @@ type testCase struct {
 	expected   interface{}
 }
 
+//testWalk checks that evaluating the expression tree gives the same result as running the compiled program
+func testWalk(t *testing.T, expression string, values map[string]interface{}, functions Functions, result interface{}, err error) {
+
+	exp, parseErr := Parse(expression)
+	if parseErr != nil {
+		return
+	}
+	walked, walkErr := Evaluate(exp, Env{Context: variables(values), Functions: functions})
+
+	if (err == nil) != (walkErr == nil) || err != nil && fmt.Sprintf("%+v", err) != fmt.Sprintf("%+v", walkErr) {
+		t.Errorf("%s : program and expression tree errors differ: %+v, %+v", expression, err, walkErr)
+		return
+	}
+	if err == nil && !reflect.DeepEqual(result, walked) {
+		t.Errorf("%s : program and expression tree results differ: %+v, %+v", expression, result, walked)
+	}
+	if l, ok := err.(interface{ locate(Span) }); ok {
+		span := reflect.ValueOf(l).Elem().FieldByName("Span").Interface()
+		walkedSpan := reflect.ValueOf(walkErr).Elem().FieldByName("Span").Interface()
+		if span != walkedSpan {
+			t.Errorf("%s : program and expression tree error spans differ: %v, %v", expression, span, walkedSpan)
+		}
+	}
+}
+
 func testEval(t *testing.T, testCases []testCase) {
 
 	for _, testCase := range testCases {
 		result, err := Eval(testCase.expression, testCase.variables)
+		testWalk(t, testCase.expression, testCase.variables, nil, result, err)
 
 		if err != nil {
 			t.Errorf("%s : error: %s", testCase.expression, err)
 			continue
 		}
 
-		if result != testCase.expected {
+		if !reflect.DeepEqual(result, testCase.expected) {
 			t.Errorf("%s : invalid result. Got %+v, expected %+v", testCase.expression, result, testCase.expected)
 		}
 	}
@@ -109,6 +145,254 @@ func TestEvalArithmetic(t *testing.T) {
 		{"5. / 2.", nil, 2.5},
 		{"6 % 2", nil, 0},
 		{"6 % 5", nil, 1},
+		{"2 ** 10", nil, 1024},
+		{"2 ** 3 ** 2 == 512", nil, true},
+		{"(2 ** 3) ** 2", nil, 64},
+		{"3 ** 0", nil, 1},
+		{"-2 ** 2", nil, -4},
+		{"(-2) ** 3", nil, -8},
+		{"2 ** -1", nil, 0.5},
+		{"2 ** 0.5 == 1.4142135623730951", nil, true},
+		{"4.0 ** 2", nil, 16.0},
+		{"2 * 3 ** 2", nil, 18},
+		{"2 ** 2 * 3", nil, 12},
+		{"2 ** 62", nil, 1 << 62},
+		{"2 ** 63", nil, math.Pow(2, 63)},
+		{"2 ** 64", nil, math.Pow(2, 64)},
+		{"10 ** 19", nil, 1e19},
+		{"(-2) ** 63", nil, math.MinInt64},
+		{"(-3) ** 41", nil, math.Pow(-3, 41)},
+		{"3 ** 40 == 12157665459056928801.0", nil, true},
+		{"0 ** 100 + 1 ** 100 + (-1) ** 101", nil, 0},
+		{"1 + 2 ** 2", nil, 5},
+	})
+}
+
+func TestEvalNumericPromotion(t *testing.T) {
+
+	testEval(t, []testCase{
+		{"2 == 2.0", nil, true},
+		{"2.0 == 2", nil, true},
+		{"2 != 2.0", nil, false},
+		{"2 != 2.5", nil, true},
+		{"a > 1", map[string]interface{}{"a": 1.5}, true},
+		{"a >= 2", map[string]interface{}{"a": 2.0}, true},
+		{"a <= 1", map[string]interface{}{"a": 1.0}, true},
+		{"1 < 1.5", nil, true},
+		{"1 + 0.5", nil, 1.5},
+		{"0.5 + 1", nil, 1.5},
+		{"3 - 0.5", nil, 2.5},
+		{"2 * 1.5", nil, 3.0},
+		{"3 / 2.0", nil, 1.5},
+		{"3.0 / 2", nil, 1.5},
+		{"3 / 2", nil, 1},
+		{"2 in [1.0, 2.0]", nil, true},
+		{"2.0 in a", map[string]interface{}{"a": []interface{}{1, 2}}, true},
+		{"[1, 2] == a", map[string]interface{}{"a": []interface{}{1.0, 2.0}}, true},
+		{"[1, 2] == a", map[string]interface{}{"a": []float64{1, 2}}, true},
+		{"[1, 2] == [1, 2, 3]", nil, false},
+		{"{'a': 1} == m", map[string]interface{}{"m": map[string]interface{}{"a": 1.0}}, true},
+		{"{'a': 1} == m", map[string]interface{}{"m": map[string]interface{}{"b": 1.0}}, false},
+		{"a.count > 3 && a.ratio < 0.5", map[string]interface{}{"a": map[string]interface{}{"count": 4.0, "ratio": 0.25}}, true},
+	})
+}
+
+type score int
+
+type status string
+
+type record struct {
+	Count   int64
+	Small   int8
+	Port    uint16
+	Big     uint64
+	Ratio   float32
+	Score   score
+	Status  status
+	Flag    bool
+	History []int32
+	Labels  map[status]uint
+}
+
+func TestEvalHostNumbers(t *testing.T) {
+	r := record{
+		Count:   10,
+		Small:   -3,
+		Port:    8080,
+		Big:     1 << 63,
+		Ratio:   0.5,
+		Score:   42,
+		Status:  "open",
+		Flag:    true,
+		History: []int32{1, 2, 3},
+		Labels:  map[status]uint{"a": 1},
+	}
+	values := map[string]interface{}{"r": r, "p": &r, "n": int64(5), "f": float32(1.5), "s": status("closed")}
+
+	testEval(t, []testCase{
+		{"r.count + 1", values, 11},
+		{"r.count * r.small", values, -30},
+		{"r.port == 8080", values, true},
+		{"r.big", values, float64(1 << 63)},
+		{"r.big > r.count", values, true},
+		{"r.ratio * 2", values, 1.0},
+		{"r.score > 40", values, true},
+		{"r.score + r.count", values, 52},
+		{"r.status == 'open'", values, true},
+		{"r.status + '!'", values, "open!"},
+		{"r.flag && true", values, true},
+		{"r.history[2] * 2", values, 6},
+		{"2 in r.history", values, true},
+		{"r.history == [1, 2, 3]", values, true},
+		{"r.labels['a'] + 1", values, 2},
+		{"'a' in r.labels", values, true},
+		{"p.count - n", values, 5},
+		{"f * 2", values, 3.0},
+		{"s", values, "closed"},
+		{"-n", values, -5},
+	})
+}
+
+func TestEvalUnary(t *testing.T) {
+
+	testEval(t, []testCase{
+		{"!true", nil, false},
+		{"!false", nil, true},
+		{"!!true", nil, true},
+		{"!(a > 1)", map[string]interface{}{"a": 2}, false},
+		{"!a && b", map[string]interface{}{"a": false, "b": true}, true},
+		{"a&&!b", map[string]interface{}{"a": true, "b": true}, false},
+		{"-a", map[string]interface{}{"a": 2}, -2},
+		{"-a", map[string]interface{}{"a": 2.5}, -2.5},
+		{"+a", map[string]interface{}{"a": 2}, 2},
+		{"-(b+c)", map[string]interface{}{"b": 1, "c": 2}, -3},
+		{"- -1", nil, 1},
+		{"a==-1", map[string]interface{}{"a": -1}, true},
+		{"2*-3", nil, -6},
+		{"-2*3", nil, -6},
+		{"1 - -1", nil, 2},
+		{"-a.b", map[string]interface{}{"a": map[string]interface{}{"b": 3}}, -3},
+	})
+}
+
+var testFunctions = Functions{
+	"double": func(i int) int { return 2 * i },
+	"half":   func(f float64) float64 { return f / 2 },
+	"max": func(first int, others ...int) int {
+		for _, o := range others {
+			if o > first {
+				first = o
+			}
+		}
+		return first
+	},
+	"join":     strings.Join,
+	"isNil":    func(v interface{}) bool { return v == nil },
+	"fail":     func() (int, error) { return 0, errors.New("failure") },
+	"none":     func() {},
+	"notAFunc": 1,
+	"lower":    func(s string) string { return "shadowed" },
+	"score":    func(s score) score { return s * 2 },
+	"isOpen":   func(s status) bool { return s == "open" },
+	"unsigned": func(u uint) uint { return u },
+}
+
+func TestEvalFunctions(t *testing.T) {
+
+	testCases := []testCase{
+		{"len(tags)", map[string]interface{}{"tags": []string{"a", "b"}}, 2},
+		{"len('été')", nil, 3},
+		{"len(m) == 1", map[string]interface{}{"m": map[string]int{"a": 1}}, true},
+		{"upper(name)", map[string]interface{}{"name": "abc"}, "ABC"},
+		{"lower('ABC')", nil, "shadowed"},
+		{"double(3)", nil, 6},
+		{"unsigned(3)", nil, 3},
+		{"double (3) + 1", nil, 7},
+		{"double(double(1+1))", nil, 8},
+		{"-double(2)", nil, -4},
+		{"half(3)", nil, 1.5},
+		{"double(2.0)", nil, 4},
+		{"max(a, b, 3)", map[string]interface{}{"a": 1, "b": 5}, 5},
+		{"max(1)", nil, 1},
+		{"join(tags, '-')", map[string]interface{}{"tags": []string{"a", "b"}}, "a-b"},
+		{"isNil(nil)", nil, true},
+		{"score(3) + 1", nil, 7},
+		{"isOpen('open')", nil, true},
+		{"len(tags) > 1 && double(len(tags)) == 4", map[string]interface{}{"tags": []int{1, 2}}, true},
+	}
+
+	for _, testCase := range testCases {
+		result, err := EvalWithFunctions(testCase.expression, testCase.variables, testFunctions)
+		testWalk(t, testCase.expression, testCase.variables, testFunctions, result, err)
+
+		if err != nil {
+			t.Errorf("%s : error: %s", testCase.expression, err)
+			continue
+		}
+
+		if result != testCase.expected {
+			t.Errorf("%s : invalid result. Got %+v, expected %+v", testCase.expression, result, testCase.expected)
+		}
+	}
+}
+
+func TestEvalInvalidFunctions(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		err        string
+	}{
+		{"unknown(1)", "undefined function 'unknown'"},
+		{"double()", "function 'double' expects 1 arguments, got 0"},
+		{"double(1, 2)", "function 'double' expects 1 arguments, got 2"},
+		{"max()", "function 'max' expects at least 1 arguments, got 0"},
+		{"double('a')", "function 'double': argument 1: cannot use string as int"},
+		{"double(1.5)", "function 'double': argument 1: cannot use 1.5 as int without loss of precision"},
+		{"max(1, 'a')", "function 'max': argument 2: cannot use string as int"},
+		{"double(nil)", "function 'double': argument 1: cannot use nil as int"},
+		{"unsigned(-1)", "function 'unsigned': argument 1: cannot use negative value -1 as uint"},
+		{"unsigned(-2.0)", "function 'unsigned': argument 1: cannot use negative value -2 as uint"},
+		{"fail()", "function 'fail': failure"},
+		{"none()", "function 'none' must return a value, or a value and an error"},
+		{"notAFunc()", "'notAFunc' is not a function"},
+		{"len(1)", "function 'len': string, array, slice or map expected"},
+		{"double(,1)", "invalid expression"},
+		{"double(1,)", "invalid expression"},
+		{"double(1 2)", "invalid syntax"},
+		{"double(1", "invalid expression"},
+		{"1, 2", "Unexpected ','"},
+		{"(1, 2)", "Unexpected ','"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := EvalWithFunctions(testCase.expression, nil, testFunctions)
+		testWalk(t, testCase.expression, nil, testFunctions, nil, err)
+
+		if err == nil || err.Error() != testCase.err {
+			t.Errorf("%s : expecting error %s, got %+v", testCase.expression, testCase.err, err)
+		}
+	}
+}
+
+func TestEvalBitwise(t *testing.T) {
+
+	testEval(t, []testCase{
+		{"flags & 4 != 0", map[string]interface{}{"flags": 6}, true},
+		{"flags & 4 != 0", map[string]interface{}{"flags": 3}, false},
+		{"flags&4==4", map[string]interface{}{"flags": uint8(4)}, true},
+		{"5 | 2", nil, 7},
+		{"6 ^ 3", nil, 5},
+		{"6 &^ 2", nil, 4},
+		{"1 << 4", nil, 16},
+		{"1 >> 2", nil, 0},
+		{"256 >> 4", nil, 16},
+		{"a&-1", map[string]interface{}{"a": 5}, 5},
+		{"1 | 2 ^ 3", nil, 0},
+		{"1 + 2 << 1", nil, 5},
+		{"(1 + 2) << 1", nil, 6},
+		{"2 & 3 | 4", nil, 6},
+		{"a < -1", map[string]interface{}{"a": -2}, true},
+		{"!a==b", map[string]interface{}{"a": true, "b": false}, true},
 	})
 }
 
@@ -120,6 +404,79 @@ func TestEvalAccessObject(t *testing.T) {
 	})
 }
 
+type address struct {
+	City string
+}
+
+type user struct {
+	Name    string
+	Address *address
+}
+
+type account struct {
+	*user
+}
+
+func TestEvalOptionalPath(t *testing.T) {
+	sparse := map[string]interface{}{
+		"user": map[string]interface{}{"address": map[string]interface{}{"city": "Paris"}},
+	}
+	testEval(t, []testCase{
+		{"user?.address?.city", sparse, "Paris"},
+		{"user.address?.city", sparse, "Paris"},
+		{"user?.address?.zip", sparse, nil},
+		{"user?.phone?.number", sparse, nil},
+		{"user?.phone.number", sparse, nil},
+		{"user?.address?.zip == nil", sparse, true},
+		{"user?.phone?.number ?? 'none'", sparse, "none"},
+		{"user?.address", map[string]interface{}{"user": nil}, nil},
+		{"u?.address?.city", map[string]interface{}{"u": &user{Name: "a", Address: &address{City: "Lyon"}}}, "Lyon"},
+		{"u?.address?.city", map[string]interface{}{"u": &user{Name: "a"}}, nil},
+		{"u?.address == nil", map[string]interface{}{"u": user{Name: "a"}}, true},
+		{"u.name", map[string]interface{}{"u": &user{Name: "a"}}, "a"},
+		{"u?.phone", map[string]interface{}{"u": user{Name: "a"}}, nil},
+		{"o.name", map[string]interface{}{"o": account{&user{Name: "c"}}}, "c"},
+		{"o?.name", map[string]interface{}{"o": account{}}, nil},
+		{"o?.address?.city", map[string]interface{}{"o": &account{}}, nil},
+		{"m.k", map[string]interface{}{"m": map[string]int{"k": 1}}, 1},
+		{"list[0].name", map[string]interface{}{"list": []user{{Name: "b"}}}, "b"},
+		{"list[0]?.address?.city", map[string]interface{}{"list": []*user{{Name: "b"}}}, nil},
+		{"{'a': {'b': 1}}.a.b", nil, 1},
+		{"a . b", map[string]interface{}{"a": map[string]interface{}{"b": 1}}, 1},
+		{"m?.x[0]", map[string]interface{}{"m": map[string]interface{}{}}, nil},
+		{"m?.x[0].y['z']", map[string]interface{}{"m": map[string]interface{}{}}, nil},
+		{"m?.x[0]", map[string]interface{}{"m": map[string]interface{}{"x": []int{5}}}, 5},
+		{"m?.x[0]?.y", map[string]interface{}{"m": map[string]interface{}{"x": []interface{}{nil}}}, nil},
+		{"nil?.x[0]", nil, nil},
+		{"'a'?.x[0]", nil, nil},
+	})
+}
+
+func TestEvalIndex(t *testing.T) {
+	event := map[string]interface{}{
+		"headers": map[string]interface{}{"x-request-id": "abc", "content type": "json"},
+		"tags":    []string{"a", "b", "c"},
+		"codes":   map[int]string{200: "ok"},
+		"point":   &struct{ X, Y int }{X: 1, Y: 2},
+		"matrix":  [2][2]int{{1, 2}, {3, 4}},
+	}
+	testEval(t, []testCase{
+		{"tags[0]", map[string]interface{}{"tags": []string{"a", "b"}}, "a"},
+		{"event.tags[i+1]", map[string]interface{}{"event": event, "i": 1}, "c"},
+		{"event.headers['x-request-id']", map[string]interface{}{"event": event}, "abc"},
+		{"event.headers['x-request-id'] != nil", map[string]interface{}{"event": event}, true},
+		{"event.headers['x-missing'] == nil", map[string]interface{}{"event": event}, true},
+		{"event['headers']['content type']", map[string]interface{}{"event": event}, "json"},
+		{"event.codes[200]", map[string]interface{}{"event": event}, "ok"},
+		{"event.point['x'] + event.point['Y']", map[string]interface{}{"event": event}, 3},
+		{"event.matrix[1][0]", map[string]interface{}{"event": event}, 3},
+		{"-event.matrix[0][1]", map[string]interface{}{"event": event}, -2},
+		{"len(event.tags[2])", map[string]interface{}{"event": event}, 1},
+		{"upper(event.tags[0])", map[string]interface{}{"event": event}, "A"},
+		{"(event.tags)[1]", map[string]interface{}{"event": event}, "b"},
+	})
+}
+
 func TestEvalIn(t *testing.T) {
 	testEval(t, []testCase{
 		{"'a' in payload", map[string]interface{}{"payload": map[string]interface{}{"a": 1}}, true},
@@ -127,20 +484,155 @@ func TestEvalIn(t *testing.T) {
 		{"'A' in payload", map[string]interface{}{"payload": struct{A int}{A: 2}}, true},
 		{"'a' in payload", map[string]interface{}{"payload": struct{A int}{A: 2}}, true},
 		{"'b' in payload", map[string]interface{}{"payload": struct{A int}{A: 2}}, false},
+		{"'name' in payload", map[string]interface{}{"payload": account{&user{}}}, true},
+		{"'name' in payload", map[string]interface{}{"payload": account{}}, false},
 		{"2 in payload", map[string]interface{}{"payload": []int{0,1,2,3}}, true},
 		{"4 in payload", map[string]interface{}{"payload": []int{1,3}}, false},
 	})
 }
 
+func TestEvalLiterals(t *testing.T) {
+	testEval(t, []testCase{
+		{"[]", nil, []interface{}{}},
+		{"[1, 'a', x]", map[string]interface{}{"x": true}, []interface{}{1, "a", true}},
+		{"[[1, 2], [3]]", nil, []interface{}{[]interface{}{1, 2}, []interface{}{3}}},
+		{"[1+2, -3, len('ab')]", nil, []interface{}{3, -3, 2}},
+		{"{}", nil, map[string]interface{}{}},
+		{"{'a': 1, 'b': x}", map[string]interface{}{"x": 2.5}, map[string]interface{}{"a": 1, "b": 2.5}},
+		{"{1: 'a', 'b': [2]}", nil, map[interface{}]interface{}{1: "a", "b": []interface{}{2}}},
+		{"{'a': {'b': 1}}['a']['b']", nil, 1},
+		{"[10, 20, 30][1]", nil, 20},
+		{"status in ['open', 'pending']", map[string]interface{}{"status": "open"}, true},
+		{"status in ['open', 'pending']", map[string]interface{}{"status": "closed"}, false},
+		{"1 in ['a', 1]", nil, true},
+		{"nil in ['a', nil]", nil, true},
+		{"[1] in [[1], [2]]", nil, true},
+		{"'a' in {'a': 1}", nil, true},
+		{"len([1, 2, 3])", nil, 3},
+		{"[1, [2]] == [1, [2]]", nil, true},
+		{"[1, 2] != [1, 3]", nil, true},
+		{"{'a': [1]} == {'a': [1]}", nil, true},
+	})
+}
+
+func TestEvalNumbers(t *testing.T) {
+	testEval(t, []testCase{
+		{"1e3", nil, 1000.0},
+		{"2.5E3", nil, 2500.0},
+		{"1e-6", nil, 1e-6},
+		{"1.5e+2", nil, 150.0},
+		{".5", nil, 0.5},
+		{"1.", nil, 1.0},
+		{"[.5, 1e2][1]", nil, 100.0},
+		{"a ?.5 : 1", map[string]interface{}{"a": true}, 0.5},
+		{"0xFF", nil, 255},
+		{"0Xff + 0o755 + 0O1", nil, 255 + 493 + 1},
+		{"0b1010", nil, 10},
+		{"0755", nil, 755},
+		{"1_000_000", nil, 1000000},
+		{"0x_ff_ff", nil, 65535},
+		{"0x_1_0000_0000_0000_0000", nil, 18446744073709551616.0},
+		{"1_0.2_5e1_0", nil, 10.25e10},
+		{"9223372036854775807", nil, math.MaxInt64},
+		{"9223372036854775808", nil, 9223372036854775808.0},
+		{"-9223372036854775808", nil, math.MinInt64},
+		{"-0x8000000000000000 + 1", nil, math.MinInt64 + 1},
+		{"-9223372036854775808 ** 1", nil, -9223372036854775808.0},
+		{"-(-9223372036854775808)", nil, 9223372036854775808.0},
+		{"-9223372036854775809", nil, -9223372036854775809.0},
+		{"0xFFFFFFFFFFFFFFFFFF", nil, float64(1<<72 - 1)},
+		{"0b1_0000000000000000000000000000000000000000000000000000000000000000", nil, float64(1 << 64)},
+	})
+}
+
+func TestEvalStrings(t *testing.T) {
+	testEval(t, []testCase{
+		{`'it\'s'`, nil, "it's"},
+		{`"say \"hi\""`, nil, `say "hi"`},
+		{`'\'"' + "\"'"`, nil, `'""'`},
+		{`'a\tb\nc\\d'`, nil, "a\tb\nc\\d"},
+		{`"\a\b\f\r\v"`, nil, "\a\b\f\r\v"},
+		{`'\u00e9\U0001F600\x41\101'`, nil, "é😀AA"},
+		{`'\xff' == '\377'`, nil, true},
+		{"`a\\n'\"\nb`", nil, "a\\n'\"\nb"},
+		{"len(`\n`)", nil, 1},
+		{`'\'\"' + "` + "`" + `"`, nil, "'\"`"},
+	})
+}
+
+func TestEvalConditional(t *testing.T) {
+	testEval(t, []testCase{
+		{"true ? 1 : 2", nil, 1},
+		{"false ? 1 : 2", nil, 2},
+		{"a > 1 ? 'big' : 'small'", map[string]interface{}{"a": 2}, "big"},
+		{"a > 1 ? 'big' : 'small'", map[string]interface{}{"a": 0}, "small"},
+		{"a ? b ? 1 : 2 : 3", map[string]interface{}{"a": true, "b": false}, 2},
+		{"a ? 1 : b ? 2 : 3", map[string]interface{}{"a": false, "b": true}, 2},
+		{"a ? 1 : b ? 2 : 3", map[string]interface{}{"a": false, "b": false}, 3},
+		{"(true ? 1 : 2) + 1", nil, 2},
+		{"true ? 1 + 1 : 2", nil, 2},
+		{"false ? -1 : -2", nil, -2},
+		{"true ? 1 : undefined", nil, 1},
+		{"false ? undefined : 2", nil, 2},
+		{"[true ? 1 : 2, 3]", nil, []interface{}{1, 3}},
+		{"{'a': false ? 1 : 2}", nil, map[string]interface{}{"a": 2}},
+		{"{true ? 'a' : 'b': 1}", nil, map[string]interface{}{"a": 1}},
+		{"len(true ? 'ab' : 'c')", nil, 2},
+		{"'abc' match 'a' ? 1 : 2", nil, 1},
+	})
+}
+
+func TestEvalCoalescing(t *testing.T) {
+	testEval(t, []testCase{
+		{"a ?? 1", map[string]interface{}{"a": 2}, 2},
+		{"a ?? 1", map[string]interface{}{"a": nil}, 1},
+		{"a ?? 1", nil, 1},
+		{"a.b.c ?? 'default'", map[string]interface{}{"a": map[string]interface{}{}}, "default"},
+		{"a ?? b ?? 3", map[string]interface{}{"b": nil}, 3},
+		{"a ?? b ?? 3", map[string]interface{}{"b": false}, false},
+		{"a['k'] ?? 'none'", map[string]interface{}{"a": map[string]interface{}{}}, "none"},
+		{"a ?? 1 + 1", nil, 2},
+		{"(a ?? 1) + 1", map[string]interface{}{"a": 5}, 6},
+		{"a ?? undefined", map[string]interface{}{"a": 5}, 5},
+		{"a ?? false ? 1 : 2", nil, 2},
+	})
+}
+
 func TestEvalMatch(t *testing.T) {
 	testEval(t, []testCase{
 		{"'abc' match 'abc'", nil, true},
 		{"'abc' match 'ab.*'", nil, true},
 		{"'aac' match 'ac.*'", nil, true},
 		{"'aac' match '^ac.*'", nil, false},
+		{"'aac' match p", map[string]interface{}{"p": "^a+c$"}, true},
+		{"'abc' match p + 'c'", map[string]interface{}{"p": "^ab"}, true},
+		{"[a match p, a match p]", map[string]interface{}{"a": "b", "p": "b|c"}, []interface{}{true, true}},
 	})
 }
 
+func TestRegexpCache(t *testing.T) {
+
+	cache := newRegexpCache(2)
+	a, _ := cache.compile("a")
+	cache.compile("b")
+	if again, _ := cache.compile("a"); again != a {
+		t.Errorf("expecting the cached regular expression")
+	}
+	cache.compile("c") //evicts 'b', the least recently used
+	if _, found := cache.entries["b"]; found || len(cache.entries) != 2 || cache.lru.Len() != 2 {
+		t.Errorf("expecting 'b' to be evicted, got %v", cache.entries)
+	}
+	if again, _ := cache.compile("a"); again != a {
+		t.Errorf("expecting the cached regular expression")
+	}
+	if _, err := cache.compile("("); err == nil {
+		t.Errorf("expecting an error")
+	}
+	if _, err := cache.compile("("); err == nil {
+		t.Errorf("expecting the cached error")
+	}
+}
+
 func TestEvalComplex(t *testing.T) {
 
 	testEval(t, []testCase{
@@ -177,18 +669,75 @@ func TestEvalInvalidSyntax(t *testing.T) {
 		{"1)", nil, "Unbalanced right parenthesis"},
 		{"(1", nil, "invalid expression"},
 		{"#", nil, "Illegal token: '#'"},
-		{"1 >> 2", nil, "Unsupported operator '>>'"},
+		{"1 = 2", nil, "Unsupported operator '='"},
+		{"a =! b", nil, "Unsupported operator '='"},
 		{"1+", nil, "invalid expression"},
 		{"(1+)", nil, "invalid expression"},
-		{"9223372036854775808", nil, "strconv.Atoi: parsing \"9223372036854775808\": value out of range"},
+		{"1e400", nil, "Number out of range: '1e400'"},
+		{"-1e400", nil, "Number out of range: '1e400'"},
+		{"0x1" + strings.Repeat("0", 300), nil, "Number out of range: '0x1" + strings.Repeat("0", 300) + "'"},
+		{"0x", nil, "Illegal token: '0x'"},
+		{"0x10000000000000000_", nil, "Illegal token: '0x10000000000000000_'"},
+		{"0b__10000000000000000000000000000000000000000000000000000000000000000", nil, "Illegal token: '0b__10000000000000000000000000000000000000000000000000000000000000000'"},
+		{"0o_1__00000000000000000000000", nil, "Illegal token: '0o_1__00000000000000000000000'"},
+		{"0b102", nil, "Illegal token: '0b102'"},
+		{"0o8", nil, "Illegal token: '0o8'"},
+		{"1__000", nil, "Illegal token: '1__000'"},
+		{"1_", nil, "Illegal token: '1_'"},
+		{"1_.5", nil, "Illegal token: '1_.5'"},
+		{"1e", nil, "Illegal token: '1e'"},
+		{"2.5e+", nil, "Illegal token: '2.5e+'"},
+		{"1.5.", nil, "Illegal token: '1.5.'"},
 		{"1.1.", nil, "Illegal token: '1.1.'"},
-		{"'a", nil, "Illegal token: 'a'"},
+		{"'a", nil, "Unterminated string"},
+		{"'a\nb'", nil, "Unterminated string"},
+		{"'\\", nil, "Unterminated string"},
+		{"'\\q'", nil, "Invalid escape sequence: '\\q'"},
+		{"'\\x4'", nil, "Invalid escape sequence: '\\x4'"},
+		{"'\\1'", nil, "Invalid escape sequence: '\\1'"},
+		{"'\\ud800'", nil, "Invalid escape sequence: '\\ud800'"},
 		{"a", nil, "undefined variable 'a'"},
 		{"a &&  || b", nil, "invalid expression"},
+		{"!", nil, "invalid expression"},
+		{"a[]", nil, "invalid expression"},
+		{"a[1", nil, "invalid expression"},
+		{"a 1]", nil, "invalid syntax"},
+		{"a]", nil, "Unbalanced right bracket"},
+		{"(a]", nil, "Unbalanced right bracket"},
+		{"a[1)", nil, "Unbalanced right parenthesis"},
+		{"a[1, 2]", nil, "Unexpected ','"},
+		{"a:1", nil, "Unexpected ':'"},
+		{"[1:2]", nil, "Unexpected ':'"},
+		{"{'a', 1}", nil, "Unexpected ','"},
+		{"{'a': 1: 2}", nil, "Unexpected ':'"},
+		{"{'a'}", nil, "Missing ':' in map literal"},
+		{"{'a': }", nil, "invalid expression"},
+		{"[1, ]", nil, "invalid expression"},
+		{"[1 2]", nil, "invalid syntax"},
+		{"a{'a': 1}", nil, "invalid syntax"},
+		{"[1", nil, "invalid expression"},
+		{"{'a': 1", nil, "invalid expression"},
+		{"1}", nil, "Unbalanced right brace"},
+		{"[1)", nil, "Unbalanced right parenthesis"},
+		{"a ? b", nil, "Missing ':' in conditional expression"},
+		{"(a ? b)", nil, "Missing ':' in conditional expression"},
+		{"a ? b : c : d", nil, "Unexpected ':'"},
+		{"a ? : c", nil, "invalid expression"},
+		{"a ?", nil, "invalid expression"},
+		{"?? a", nil, "invalid expression"},
+		{"1 -", nil, "invalid expression"},
 		{"a.b", nil, "undefined variable 'a.b'"},
 		{"a.b", map[string]interface{}{"a":1}, "undefined variable 'a.b'"},
 		{"a.b", map[string]interface{}{"a":map[string]interface{}{"c":1}}, "undefined variable 'a.b'"},
 		{"a.B", map[string]interface{}{"a": struct{A int}{A: 2}}, "undefined variable 'a.B'"},
+		{"a?.b.c", map[string]interface{}{"a": map[string]interface{}{"b": 1}}, "undefined variable 'a?.b.c'"},
+		{"a.b?.c", nil, "undefined variable 'a.b?.c'"},
+		{"a[0].b", map[string]interface{}{"a": []int{1}}, "undefined field 'b'"},
+		{"len(x).b", nil, "undefined variable 'x'"},
+		{"u?.address.city", map[string]interface{}{"u": user{Name: "a"}}, "undefined variable 'u?.address.city'"},
+		{"a.", nil, "Identifier expected after '.'"},
+		{"a?.'b'", nil, "Identifier expected after '?.'"},
+		{".a", nil, "invalid expression"},
 	}
 
 	for _, testCase := range testCases {
@@ -204,6 +753,88 @@ func TestEvalInvalidSyntax(t *testing.T) {
 		}
 	}
 }
+func TestParseSyntaxError(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		start      Position
+		end        Position
+		expected   []string
+		formatted  string
+	}{
+		{"", Position{0, 1, 1}, Position{0, 1, 1}, []string{"operand"}, "1:1: invalid syntax (expected operand)\n\n^"},
+		{"a &&  || b", Position{6, 1, 7}, Position{8, 1, 9}, []string{"operand"}, "1:7: invalid expression (expected operand)\na &&  || b\n      ^^"},
+		{"1 1", Position{2, 1, 3}, Position{3, 1, 4}, []string{"operator"}, "1:3: invalid syntax (expected operator)\n1 1\n  ^"},
+		{"#", Position{0, 1, 1}, Position{1, 1, 2}, nil, "1:1: Illegal token: '#'\n#\n^"},
+		{"a > 1 &&\n\t(b < 2", Position{10, 2, 2}, Position{11, 2, 3}, []string{"')'"}, "2:2: invalid expression (expected ')')\n\t(b < 2\n\t^"},
+		{"a ? b", Position{2, 1, 3}, Position{3, 1, 4}, []string{"':'"}, "1:3: Missing ':' in conditional expression (expected ':')\na ? b\n  ^"},
+		{"a = 1", Position{2, 1, 3}, Position{3, 1, 4}, []string{"operator"}, "1:3: Unsupported operator '=' (expected operator)\na = 1\n  ^"},
+		{"a ! b", Position{2, 1, 3}, Position{3, 1, 4}, []string{"operator"}, "1:3: Unsupported operator '!' (expected operator)\na ! b\n  ^"},
+		{"a.", Position{2, 1, 3}, Position{2, 1, 3}, []string{"identifier"}, "1:3: Identifier expected after '.' (expected identifier)\na.\n  ^"},
+		{"{'a': 1: 2}", Position{7, 1, 8}, Position{8, 1, 9}, []string{"','", "'}'"}, "1:8: Unexpected ':' (expected ',' or '}')\n{'a': 1: 2}\n       ^"},
+		{"a match\n  'x(' ", Position{10, 2, 3}, Position{14, 2, 7}, nil, "2:3: Invalid regular expression: error parsing regexp: missing closing ): `x(`\n  'x(' \n  ^^^^"},
+		{"a == 'b +\n1", Position{5, 1, 6}, Position{6, 1, 7}, nil, "1:6: Unterminated string\na == 'b +\n     ^"},
+		{"'\\x4'", Position{1, 1, 2}, Position{4, 1, 5}, nil, "1:2: Invalid escape sequence: '\\x4'\n'\\x4'\n ^^^"},
+		{"\"a\\tb\\c\"", Position{5, 1, 6}, Position{7, 1, 8}, nil, "1:6: Invalid escape sequence: '\\c'\n\"a\\tb\\c\"\n     ^^"},
+		{"'é' + 0b12", Position{7, 1, 7}, Position{11, 1, 11}, nil, "1:7: Illegal token: '0b12'\n'é' + 0b12\n      ^^^^"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := Parse(testCase.expression)
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%s : expecting a syntax error, got %v", testCase.expression, err)
+			continue
+		}
+		if syntaxErr.Span.Start != testCase.start || syntaxErr.Span.End != testCase.end {
+			t.Errorf("%s : invalid span. Got %s, expected %s-%s", testCase.expression, syntaxErr.Span, testCase.start, testCase.end)
+		}
+		if !reflect.DeepEqual(syntaxErr.Expected, testCase.expected) {
+			t.Errorf("%s : invalid expected tokens. Got %v, expected %v", testCase.expression, syntaxErr.Expected, testCase.expected)
+		}
+		if formatted := fmt.Sprintf("%+v", err); formatted != testCase.formatted {
+			t.Errorf("%s : invalid format. Got\n%s\nexpected\n%s", testCase.expression, formatted, testCase.formatted)
+		}
+		if fmt.Sprintf("%v", err) != syntaxErr.Msg {
+			t.Errorf("%s : invalid message. Got %v, expected %s", testCase.expression, err, syntaxErr.Msg)
+		}
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		start      int
+		end        int
+	}{
+		{"  a ", 2, 3},
+		{"a + b * 2", 0, 9},
+		{"-(a)", 0, 3},
+		{"(a + b)", 1, 6},
+		{"f(1, 2) ", 0, 7},
+		{"a.b?.c", 0, 6},
+		{"a[1]", 0, 4},
+		{"[1, 2]", 0, 6},
+		{"{'a': 1}", 0, 8},
+		{"a ? b : c", 0, 9},
+	}
+
+	for _, testCase := range testCases {
+		exp, err := Parse(testCase.expression)
+		if err != nil {
+			t.Errorf("%s : error: %s", testCase.expression, err)
+			continue
+		}
+
+		span := exp.(interface{ Span() Span }).Span()
+		if span.Start.Offset != testCase.start || span.End.Offset != testCase.end {
+			t.Errorf("%s : invalid span. Got %d-%d, expected %d-%d", testCase.expression, span.Start.Offset, span.End.Offset, testCase.start, testCase.end)
+		}
+	}
+}
+
 func TestEvalInvalidTypes(t *testing.T) {
 
 	testCases := []struct {
@@ -221,16 +852,48 @@ func TestEvalInvalidTypes(t *testing.T) {
 		{"'a' * 0", nil, "incompatible types in product"},
 		{"'a' / 0", nil, "incompatible types in quotient"},
 		{"'a' % 0", nil, "incompatible types in modulo"},
+		{"'a' ** 2", nil, "incompatible types in power"},
+		{"1.5 & 1", nil, "integers expected in operator &"},
+		{"1 << -1", nil, "negative shift count -1"},
+		{"true | false", nil, "integers expected in operator |"},
 		{"('a' > 0) || 1>0", nil, "incompatible types in comparison"},
 		{"1>0 && ('a' > 0)", nil, "incompatible types in comparison"},
 		{"3 in payload", map[string]interface{}{"payload": map[string]interface{}{"a": 1}}, "invalid key type in operator in"},
 		{"1 in payload", map[string]interface{}{"payload": []string{"test"}}, "invalid type in operator in"},
 		{"5 in payload", map[string]interface{}{"payload": 1}, "unsupported types in operator in"},
 		{"5 match '5'", nil, "unsupported types in operator match"},
+		{"a[3]", map[string]interface{}{"a": []int{1, 2, 3}}, "index 3 out of range (length 3)"},
+		{"a[-1]", map[string]interface{}{"a": []int{1, 2, 3}}, "negative index -1"},
+		{"a['0']", map[string]interface{}{"a": []int{1, 2, 3}}, "integer expected as index"},
+		{"a[0]", map[string]interface{}{"a": map[string]int{}}, "invalid key type in index: cannot use int as string"},
+		{"ui[-1]", map[string]interface{}{"ui": map[uint]int{math.MaxUint64: 7}}, "invalid key type in index: cannot use negative value -1 as uint"},
+		{"-1 in ui", map[string]interface{}{"ui": map[uint]int{math.MaxUint64: 7}}, "invalid key type in operator in"},
+		{"a[b]", map[string]interface{}{"a": map[interface{}]int{}, "b": []int{}}, "unhashable key type in index"},
+		{"{[1]: 2}", nil, "unhashable key type in map literal"},
+		{"[1] in {'a': 1}", nil, "invalid key type in operator in"},
+		{"[1] in a", map[string]interface{}{"a": map[interface{}]int{}}, "unhashable key type in operator in"},
+		{"a['z']", map[string]interface{}{"a": struct{ A int }{A: 2}}, "undefined field 'z'"},
+		{"a['name']", map[string]interface{}{"a": account{}}, "undefined field 'name'"},
+		{"a[0]", map[string]interface{}{"a": struct{ A int }{A: 2}}, "string expected as field name"},
+		{"a[0]", map[string]interface{}{"a": 1}, "unsupported type in index"},
+		{"a[0]", map[string]interface{}{"a": nil}, "unsupported type in index"},
+		{"1 ? 2 : 3", nil, "boolean expected in conditional expression"},
+		{"a[5] ?? 1", map[string]interface{}{"a": []int{}}, "index 5 out of range (length 0)"},
+		{"a ?? b", nil, "undefined variable 'b'"},
+		{"(a + typo) ?? 0", map[string]interface{}{"a": 1}, "undefined variable 'typo'"},
+		{"len(typo) ?? 0", nil, "undefined variable 'typo'"},
+		{"[typo][0] ?? 0", nil, "undefined variable 'typo'"},
+		{"(typo ? 1 : 2) ?? 3", nil, "undefined variable 'typo'"},
+		{"a[typo] ?? 0", map[string]interface{}{"a": map[string]interface{}{}}, "undefined variable 'typo'"},
+		{"a.b[c.d] ?? 0", map[string]interface{}{"a": map[string]interface{}{"b": []int{1}}, "c": map[string]interface{}{}}, "undefined variable 'c.d'"},
+		{"!1", nil, "boolean expected in NOT expression"},
+		{"-'a'", nil, "incompatible type in negation"},
+		{"+true", nil, "incompatible type in identity"},
 	}
 
 	for _, testCase := range testCases {
 		_, err := Eval(testCase.expression, testCase.variables)
+		testWalk(t, testCase.expression, testCase.variables, nil, nil, err)
 
 		if err == nil || err.Error() != testCase.err {
 			t.Errorf("%s : expecting error %s, got %+v", testCase.expression, testCase.err, err)
@@ -239,6 +902,967 @@ func TestEvalInvalidTypes(t *testing.T) {
 	}
 }
 
+func TestEvalErrorTypes(t *testing.T) {
+
+	failure := errors.New("failure")
+	functions := Functions{"fail": func() (int, error) { return 0, failure }}
+
+	testCases := []struct {
+		expression string
+		variables  map[string]interface{}
+		span       string
+		check      func(err error) bool
+	}{
+		{"1 + a", nil, "a", func(err error) bool {
+			var e *UndefinedVariableError
+			return errors.As(err, &e) && e.Name == "a"
+		}},
+		{"a.b.c > 1", map[string]interface{}{"a": map[string]interface{}{}}, "a.b.c", func(err error) bool {
+			var e *UndefinedVariableError
+			return errors.As(err, &e) && e.Name == "a.b.c"
+		}},
+		{"a[0].b", map[string]interface{}{"a": []interface{}{struct{}{}}}, "a[0].b", func(err error) bool {
+			var e *UndefinedFieldError
+			return errors.As(err, &e) && e.Name == "b"
+		}},
+		{"o.name", map[string]interface{}{"o": account{}}, "o.name", func(err error) bool {
+			var e *UndefinedVariableError
+			return errors.As(err, &e) && e.Name == "o.name"
+		}},
+		{"1 + nope(2)", nil, "nope(2)", func(err error) bool {
+			var e *UndefinedFunctionError
+			return errors.As(err, &e) && e.Name == "nope"
+		}},
+		{"true && ('a' + 1 > 0)", nil, "'a' + 1", func(err error) bool {
+			var e *TypeMismatchError
+			return errors.As(err, &e) && e.Operator == "+" &&
+				reflect.DeepEqual(e.Operands, []reflect.Type{reflect.TypeOf(""), reflect.TypeOf(0)})
+		}},
+		{"-a", map[string]interface{}{"a": nil}, "-a", func(err error) bool {
+			var e *TypeMismatchError
+			return errors.As(err, &e) && e.Operator == "-" && reflect.DeepEqual(e.Operands, []reflect.Type{nil})
+		}},
+		{"a > 1", map[string]interface{}{"a": "b"}, "a > 1", func(err error) bool {
+			var e *TypeMismatchError
+			return errors.As(err, &e) && e.Operator == ">"
+		}},
+		{"2 * (1 / a)", map[string]interface{}{"a": 0}, "1 / a", func(err error) bool {
+			var e *DivisionByZeroError
+			return errors.As(err, &e) && e.Operator == "/"
+		}},
+		{"5 % 0", nil, "5 % 0", func(err error) bool {
+			var e *DivisionByZeroError
+			return errors.As(err, &e) && e.Operator == "%"
+		}},
+		{"[1, 2][2]", nil, "[1, 2][2]", func(err error) bool {
+			var e *IndexOutOfRangeError
+			return errors.As(err, &e) && e.Index == 2 && e.Length == 2
+		}},
+		{"1 << -2", nil, "1 << -2", func(err error) bool {
+			var e *InvalidOperationError
+			return errors.As(err, &e) && e.Operator == "<<"
+		}},
+		{"'a' match p", map[string]interface{}{"p": "("}, "'a' match p", func(err error) bool {
+			var e *InvalidOperationError
+			return errors.As(err, &e) && e.Operator == "match"
+		}},
+		{"double('a')", nil, "double('a')", func(err error) bool {
+			var e *FunctionError
+			return errors.As(err, &e) && e.Name == "double" && e.Err == nil
+		}},
+		{"fail() + 1", nil, "fail()", func(err error) bool {
+			var e *FunctionError
+			return errors.As(err, &e) && e.Name == "fail" && errors.Is(err, failure)
+		}},
+	}
+
+	for name, fn := range testFunctions {
+		if _, found := functions[name]; !found {
+			functions[name] = fn
+		}
+	}
+
+	for _, testCase := range testCases {
+		_, err := EvalWithFunctions(testCase.expression, testCase.variables, functions)
+		testWalk(t, testCase.expression, testCase.variables, functions, nil, err)
+
+		if err == nil || !testCase.check(err) {
+			t.Errorf("%s : unexpected error %#v", testCase.expression, err)
+			continue
+		}
+
+		l, ok := err.(interface{ locate(Span) })
+		if !ok {
+			t.Errorf("%s : error %T is not located", testCase.expression, err)
+			continue
+		}
+		span := reflect.ValueOf(l).Elem().FieldByName("Span").Interface().(Span)
+		if got := testCase.expression[span.Start.Offset:span.End.Offset]; got != testCase.span {
+			t.Errorf("%s : expecting error located at '%s', got '%s'", testCase.expression, testCase.span, got)
+		}
+	}
+}
+
+func TestEvalDivisionByZero(t *testing.T) {
+
+	for _, expression := range []string{"1 / 0", "a % 0", "1 / (a - 2)"} {
+		_, err := Eval(expression, map[string]interface{}{"a": 2})
+		var e *DivisionByZeroError
+		if !errors.As(err, &e) || e.Float {
+			t.Errorf("%s : expecting integer division by zero, got %v", expression, err)
+		}
+	}
+
+	testEval(t, []testCase{
+		{"1.0 / 0 == a", map[string]interface{}{"a": math.Inf(1)}, true},
+		{"-1 / 0.0 == a", map[string]interface{}{"a": math.Inf(-1)}, true},
+	})
+	if r, err := Eval("0.0 / 0", nil); err != nil || !math.IsNaN(r.(float64)) {
+		t.Errorf("0.0 / 0 : expecting NaN, got %v, %v", r, err)
+	}
+
+	exp, err := Parse("1 + a / b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{Context: variables(map[string]interface{}{"a": 1.5, "b": 0}), StrictFloatDivision: true}
+	_, err = Evaluate(exp, env)
+	var e *DivisionByZeroError
+	if !errors.As(err, &e) || !e.Float || e.Span.Start.Offset != 4 || err.Error() != "float division by zero" {
+		t.Errorf("expecting float division by zero, got %v", err)
+	}
+
+	//A constant division is strict when the context the program is run against is
+	p, err := Compile("1 + 1.0 / 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Run(Env{Context: variables(nil), StrictFloatDivision: true}); !errors.As(err, &e) || e.Span.Start.Offset != 4 {
+		t.Errorf("expecting float division by zero, got %v", err)
+	}
+	if r, err := p.Eval(nil); err != nil || !math.IsInf(r.(float64), 1) {
+		t.Errorf("expecting +Inf, got %v, %v", r, err)
+	}
+	if _, err := Compile("1.0 / 0", WithStrictFloatDivision()); !errors.As(err, &e) {
+		t.Errorf("expecting float division by zero, got %v", err)
+	}
+}
+
+type panicContext struct{}
+
+func (panicContext) Value(name string) (interface{}, bool) {
+	panic("no value for " + name)
+}
+
+func TestEvalPanic(t *testing.T) {
+
+	crash := errors.New("crash")
+	functions := Functions{
+		"boom":  func() int { panic("boom") },
+		"crash": func(i int) int { panic(crash) },
+	}
+
+	testCases := []struct {
+		expression string
+		err        string
+	}{
+		{"1 + boom()", "function 'boom': panic during evaluation: boom"},
+		{"crash(1) > 0", "function 'crash': panic during evaluation: crash"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := EvalWithFunctions(testCase.expression, nil, functions)
+
+		var e *PanicError
+		if !errors.As(err, &e) || err.Error() != testCase.err {
+			t.Errorf("%s : expecting error %s, got %v", testCase.expression, testCase.err, err)
+		}
+	}
+	if _, err := EvalWithFunctions("crash(1)", nil, functions); !errors.Is(err, crash) {
+		t.Errorf("expecting the error passed to panic, got %v", err)
+	}
+
+	exp, err := Parse("a > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Evaluate(exp, panicContext{})
+	var e *PanicError
+	if !errors.As(err, &e) || e.Value != "no value for a" {
+		t.Errorf("expecting a panic error, got %v", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+
+	p, err := Compile("double(a) + b > 10", WithFunctions(testFunctions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source() != "double(a) + b > 10" {
+		t.Errorf("unexpected source %s", p.Source())
+	}
+
+	testCases := []struct {
+		variables map[string]interface{}
+		expected  interface{}
+	}{
+		{map[string]interface{}{"a": 1, "b": 2}, false},
+		{map[string]interface{}{"a": 5, "b": 0.5}, true},
+	}
+	for _, testCase := range testCases {
+		result, err := p.Eval(testCase.variables)
+		if err != nil || result != testCase.expected {
+			t.Errorf("%v : expecting %v, got %v, %v", testCase.variables, testCase.expected, result, err)
+		}
+	}
+
+	//Functions given at compilation shadow the ones of the context, which shadow the built-in functions
+	p, err = Compile("len(a) + twice(1)", WithFunctions(Functions{"len": func(s string) int { return 10 }}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{Context: variables(map[string]interface{}{"a": "abc"}), Functions: Functions{"twice": func(i int) int { return 2 * i }}}
+	if result, err := p.Run(env); err != nil || result != 12 {
+		t.Errorf("expecting 12, got %v, %v", result, err)
+	}
+
+	p, err = Compile("1 / a", WithStrictFloatDivision())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e *DivisionByZeroError
+	if _, err := p.Eval(map[string]interface{}{"a": 0.0}); !errors.As(err, &e) {
+		t.Errorf("expecting a division by zero, got %v", err)
+	}
+
+	var syntaxError *SyntaxError
+	if _, err := Compile("1 +"); !errors.As(err, &syntaxError) {
+		t.Errorf("expecting a syntax error, got %v", err)
+	}
+}
+
+func TestProgramEval(t *testing.T) {
+
+	values := map[string]interface{}{
+		"a": map[string]interface{}{"b": 1, "n": nil},
+		"l": []interface{}{1, 2.5, "x"},
+	}
+	testCases := []testCase{
+		{"max(1, a.c ?? 4, [x ?? 3][0]) + 1", values, 5},
+		{"(a.c ?? a.n ?? a?.d?.e ?? l[0]) + (a.n ?? 0 ?? 1)", values, 1},
+		{"a.b > 0 ? (a.z ?? l[1]) * 2 : 0", values, 5.0},
+		{"[a?.x?.y, a?.n?.y, {'k': a.b ?? 0}]", values, []interface{}{nil, nil, map[string]interface{}{"k": 1}}},
+		{"!(a.b == 1 && l[2] == 'x') || len(l) in [3]", values, true},
+	}
+	for _, testCase := range testCases {
+		p, err := Compile(testCase.expression, WithFunctions(testFunctions))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := p.Eval(testCase.variables)
+		testWalk(t, testCase.expression, testCase.variables, testFunctions, result, err)
+		if err != nil || !reflect.DeepEqual(result, testCase.expected) {
+			t.Errorf("%s : expecting %v, got %v, %v", testCase.expression, testCase.expected, result, err)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+
+	optimized := func(s string) Expression {
+		exp, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err = optimize(exp, variables(nil))
+		if err != nil {
+			t.Fatalf("%s : error: %s", s, err)
+		}
+		return exp
+	}
+
+	testCases := []struct {
+		expression string
+		expected   string //Go syntax of the optimized expression, spans excepted
+	}{
+		{"3 + 1", "gript.IntLiteral{Value:4"},
+		{"2 ** 0.5 > 1 ? 'a' + 'b' : c", "gript.StringLiteral{Value:\"ab\""},
+		{"-(1 - 1.5)", "gript.FloatLiteral{Value:0.5"},
+		{"!(1 > 2) || a", "gript.Identifier{Name:\"true\""},
+		{"false && a", "gript.Identifier{Name:\"false\""},
+		{"nil ?? 1 + 1", "gript.IntLiteral{Value:2"},
+		{"'a'.b ?? 3", "gript.IntLiteral{Value:3"},
+		{"true && a > 1", "gript.BinaryExpression{Operator:\">\""},
+		{"a > 1 || false", "gript.BinaryExpression{Operator:\">\""},
+		{"true && a", "gript.BinaryExpression{Operator:\"&&\""},
+		{"a || false", "gript.BinaryExpression{Operator:\"||\""},
+		{"ab > 3+1", "Right:gript.IntLiteral{Value:4"},
+		{"a match 'b+'", "Right:gript.PatternLiteral{"},
+		{"[1 + 1, a]", "Items:[]gript.Expression{gript.IntLiteral{Value:2"},
+		{"f(-1)", "Args:[]gript.Expression{gript.IntLiteral{Value:-1"},
+	}
+
+	for _, testCase := range testCases {
+		exp := optimized(testCase.expression)
+		if s := fmt.Sprintf("%#v", exp); !strings.Contains(s, testCase.expected) {
+			t.Errorf("%s : expecting %s, got %s", testCase.expression, testCase.expected, s)
+		}
+	}
+}
+
+func TestCompileConstantErrors(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		err        string
+		span       string
+	}{
+		{"('a' + 1 > 0) && a", "incompatible types in sum", "'a' + 1"},
+		{"[1, 2 / 0]", "integer division by zero", "2 / 0"},
+		{"false ? a : -'b'", "incompatible type in negation", "-'b'"},
+		{"1 ? a : b", "boolean expected in conditional expression", "1 ? a : b"},
+		{"a match '(' + ''", "error parsing regexp: missing closing ): `(`", "'(' + ''"},
+		{"len('a'.b) ?? 1", "undefined field 'b'", "'a'.b"},
+		{"[1]['a'.b] ?? 1", "undefined field 'b'", "'a'.b"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := Compile(testCase.expression)
+		if err == nil || err.Error() != testCase.err {
+			t.Errorf("%s : expecting error %s, got %v", testCase.expression, testCase.err, err)
+			continue
+		}
+		span := reflect.ValueOf(err).Elem().FieldByName("Span").Interface().(Span)
+		if got := testCase.expression[span.Start.Offset:span.End.Offset]; got != testCase.span {
+			t.Errorf("%s : expecting error located at '%s', got '%s'", testCase.expression, testCase.span, got)
+		}
+	}
+
+	//An undefined variable in the left part of '??' gives the right part, before a constant error is met
+	if r, err := Eval("z[1 / 0] ?? 1", nil); err != nil || r != 1 {
+		t.Errorf("expecting 1, got %v, %v", r, err)
+	}
+
+	//Errors in parts that may not be evaluated are only reported when they are evaluated
+	lazyCases := []struct {
+		expression string
+		variables  map[string]interface{}
+		err        string
+	}{
+		{"a ?? 'a' + 1", nil, "incompatible types in sum"},
+		{"z < '' | 2 ?? 1", map[string]interface{}{"z": 1}, "integers expected in operator |"},
+		{"a && 1 / 0 > 0", map[string]interface{}{"a": true}, "integer division by zero"},
+		{"a ? 1 : 1 % 0", map[string]interface{}{"a": false}, "integer division by zero"},
+		{"a || 'x' match '(' + ''", map[string]interface{}{"a": false}, "error parsing regexp: missing closing ): `(`"},
+	}
+	for _, testCase := range lazyCases {
+		p, err := Compile(testCase.expression)
+		if err != nil {
+			t.Errorf("%s : unexpected error %s", testCase.expression, err)
+			continue
+		}
+		if _, err := p.Eval(testCase.variables); err == nil || err.Error() != testCase.err {
+			t.Errorf("%s : expecting error %s, got %v", testCase.expression, testCase.err, err)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	functions := Functions{"cancel": func(i int) int { cancel(); return i }}
+
+	p, err := Compile("cancel(1) + double(2)", WithFunctions(functions), WithFunctions(testFunctions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.RunContext(ctx, variables(nil)); err != context.Canceled {
+		t.Errorf("expecting the evaluation to be cancelled, got %v, %v", r, err)
+	}
+	if _, err := p.RunContext(ctx, variables(nil)); err != context.Canceled {
+		t.Errorf("expecting the evaluation to be cancelled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if _, err := EvalContext(ctx, "1 + 1", nil); err != context.DeadlineExceeded {
+		t.Errorf("expecting the deadline to be exceeded, got %v", err)
+	}
+	if r, err := EvalContext(context.Background(), "a + 1", map[string]interface{}{"a": 1}); err != nil || r != 2 {
+		t.Errorf("expecting 2, got %v, %v", r, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+
+	functions := Functions{"repeat": strings.Repeat, "split": strings.Split}
+
+	testCases := []struct {
+		expression string
+		variables  map[string]interface{}
+		limits     Limits
+		err        error
+		span       string
+	}{
+		{"a + a + a", map[string]interface{}{"a": 1}, Limits{MaxSteps: 4}, ErrStepLimit, "a + a + a"},
+		{"a + a + a", map[string]interface{}{"a": 1}, Limits{MaxSteps: 5}, nil, ""},
+		{"-(-(-a))", nil, Limits{MaxDepth: 3}, ErrDepthLimit, "a"},
+		{"-(-(-a))", map[string]interface{}{"a": 1}, Limits{MaxDepth: 4}, nil, ""},
+		{"a + a", map[string]interface{}{"a": "abcd"}, Limits{MaxStringLength: 7}, ErrStringLimit, "a + a"},
+		{"a + a", map[string]interface{}{"a": "abcd"}, Limits{MaxStringLength: 8}, nil, ""},
+		{"len(repeat(a, 10))", map[string]interface{}{"a": "abcd"}, Limits{MaxStringLength: 8}, ErrStringLimit, "repeat(a, 10)"},
+		{"[a, a, a]", map[string]interface{}{"a": 1}, Limits{MaxCollectionSize: 2}, ErrCollectionLimit, "[a, a, a]"},
+		{"{'a': a, 'b': a, 'c': 2}", map[string]interface{}{"a": 1}, Limits{MaxCollectionSize: 2}, ErrCollectionLimit, "{'a': a, 'b': a, 'c': 2}"},
+		{"split(a, '') ?? 1", map[string]interface{}{"a": "abc"}, Limits{MaxCollectionSize: 2}, ErrCollectionLimit, "split(a, '')"},
+		{"a match '^a'", map[string]interface{}{"a": "abc"}, Limits{MaxMatchLength: 2}, ErrMatchLimit, "a match '^a'"},
+		{"a match '^a'", map[string]interface{}{"a": "abc"}, Limits{MaxMatchLength: 3}, nil, ""},
+		{"'aaaaaaaaaaa' match 'a+'", nil, Limits{MaxMatchLength: 2}, ErrMatchLimit, "'aaaaaaaaaaa' match 'a+'"},
+		{"'aaaaaaaaaa' + 'bbbbbbbbbb'", nil, Limits{MaxStringLength: 5}, ErrStringLimit, "'aaaaaaaaaa' + 'bbbbbbbbbb'"},
+		{"a ?? 'aaaaaaaaaa' + 'bbbbbbbbbb'", map[string]interface{}{"a": 1}, Limits{MaxStringLength: 5}, nil, ""},
+		{"'a' + 'b' + 'c'", nil, Limits{MaxSteps: 1, MaxStringLength: 3}, nil, ""},
+	}
+
+	for _, testCase := range testCases {
+		p, err := Compile(testCase.expression, WithFunctions(functions), WithLimits(testCase.limits))
+		if err == nil {
+			_, err = p.Eval(testCase.variables)
+		}
+
+		if testCase.err == nil {
+			if err != nil {
+				t.Errorf("%s : unexpected error %s", testCase.expression, err)
+			}
+			continue
+		}
+		var e *LimitError
+		if !errors.Is(err, testCase.err) || !errors.As(err, &e) {
+			t.Errorf("%s : expecting error %s, got %v", testCase.expression, testCase.err, err)
+			continue
+		}
+		if got := testCase.expression[e.Span.Start.Offset:e.Span.End.Offset]; got != testCase.span {
+			t.Errorf("%s : expecting error located at '%s', got '%s'", testCase.expression, testCase.span, got)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		variables  []string //names, followed by the source of each occurrence
+		functions  []string
+	}{
+		{"1 + 2", nil, nil},
+		{"a", []string{"a: a"}, nil},
+		{"payload.x > 1 && a.b?.c == payload.x", []string{"payload.x: payload.x payload.x", "a.b.c: a.b?.c"}, nil},
+		{"len(a.b[i].c) + len(nil.a)", []string{"a.b: a.b", "i: i"}, []string{"len: len(a.b[i].c) len(nil.a)"}},
+		{"lower(f(x).y) in ['a', b] ? true : c ?? {d: e}", []string{"x: x", "b: b", "c: c", "d: d", "e: e"}, []string{"lower: lower(f(x).y)", "f: f(x)"}},
+	}
+
+	format := func(source string, dependencies []Dependency) []string {
+		var formatted []string
+		for _, d := range dependencies {
+			occurrences := make([]string, len(d.Spans))
+			for i, span := range d.Spans {
+				occurrences[i] = source[span.Start.Offset:span.End.Offset]
+			}
+			formatted = append(formatted, d.Name+": "+strings.Join(occurrences, " "))
+		}
+		return formatted
+	}
+
+	for _, testCase := range testCases {
+		p, err := Compile(testCase.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := p.Dependencies()
+		if variables := format(testCase.expression, d.Variables); !reflect.DeepEqual(variables, testCase.variables) {
+			t.Errorf("%s : expecting variables %q, got %q", testCase.expression, testCase.variables, variables)
+		}
+		if functions := format(testCase.expression, d.Functions); !reflect.DeepEqual(functions, testCase.functions) {
+			t.Errorf("%s : expecting functions %q, got %q", testCase.expression, testCase.functions, functions)
+		}
+	}
+}
+
+type typeVisitor struct{ visited *[]string }
+
+func (v typeVisitor) Visit(e Expression) Visitor {
+	*v.visited = append(*v.visited, strings.TrimPrefix(fmt.Sprintf("%T", e), "gript."))
+	return v
+}
+
+func TestWalk(t *testing.T) {
+
+	exp, err := Parse("-a.b[0] + f(1, 'x') > (c ? 2.5 : {'k': [d]})")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var visited []string
+	Walk(typeVisitor{&visited}, exp)
+	expected := []string{
+		"BinaryExpression",
+		"BinaryExpression",
+		"UnaryExpression", "IndexExpression", "MemberExpression", "Identifier", "<nil>", "<nil>",
+		"IntLiteral", "<nil>", "<nil>", "<nil>",
+		"CallExpression", "IntLiteral", "<nil>", "StringLiteral", "<nil>", "<nil>", "<nil>",
+		"ConditionalExpression", "Identifier", "<nil>", "FloatLiteral", "<nil>",
+		"MapLiteral", "StringLiteral", "<nil>", "ListLiteral", "Identifier", "<nil>", "<nil>", "<nil>", "<nil>",
+		"<nil>",
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("invalid walk. Got %v", visited)
+	}
+
+	var identifiers []string
+	Inspect(exp, func(e Expression) bool {
+		switch e := e.(type) {
+		case Identifier:
+			identifiers = append(identifiers, e.Name)
+		case ConditionalExpression:
+			return false
+		}
+		return true
+	})
+	if !reflect.DeepEqual(identifiers, []string{"a"}) {
+		t.Errorf("invalid inspection. Got %v", identifiers)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+
+	exp, err := Parse("user.name == 'x' || len(user.tags) > limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Rename the variable user to account, and replace limit by a constant
+	rewritten := Rewrite(exp, func(e Expression) Expression {
+		switch e := e.(type) {
+		case Identifier:
+			if e.Name == "user" {
+				e.Name = "account"
+				return e
+			}
+			if e.Name == "limit" {
+				return IntLiteral{Value: 2}
+			}
+		}
+		return e
+	})
+
+	p, err := CompileExpression(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variableNames := func(d Dependencies) []string {
+		var names []string
+		for _, v := range d.Variables {
+			names = append(names, v.Name)
+		}
+		return names
+	}
+	if names := variableNames(p.Dependencies()); !reflect.DeepEqual(names, []string{"account.name", "account.tags"}) {
+		t.Errorf("invalid rewritten variables %v", names)
+	}
+	if names := variableNames(DependenciesOf(exp)); !reflect.DeepEqual(names, []string{"user.name", "user.tags", "limit"}) {
+		t.Errorf("the original expression must be unchanged, got variables %v", names)
+	}
+
+	account := map[string]interface{}{"name": "y", "tags": []string{"a", "b", "c"}}
+	if r, err := p.Eval(map[string]interface{}{"account": account}); err != nil || r != true {
+		t.Errorf("expecting true, got %v, %v", r, err)
+	}
+
+	//Trees can also be built directly
+	built := BinaryExpression{Operator: "*", Left: Identifier{Name: "a"}, Right: UnaryExpression{Operator: "-", Operand: FloatLiteral{Value: 1.5}}}
+	if r, err := Evaluate(built, variables{"a": 2}); err != nil || r != -3.0 {
+		t.Errorf("expecting -3, got %v, %v", r, err)
+	}
+}
+
+//withoutSpans returns a copy of an expression tree without spans, its patterns being replaced by strings, to compare trees
+func withoutSpans(e Expression) Expression {
+	return Rewrite(e, func(e Expression) Expression {
+		switch e := e.(type) {
+		case IntLiteral:
+			e.span = Span{}
+			return e
+		case FloatLiteral:
+			e.span = Span{}
+			return e
+		case StringLiteral:
+			e.span = Span{}
+			return e
+		case PatternLiteral:
+			return StringLiteral{Value: e.Regexp.String()}
+		case Identifier:
+			e.span = Span{}
+			return e
+		case ListLiteral:
+			e.span = Span{}
+			return e
+		case MapLiteral:
+			e.span = Span{}
+			return e
+		case MemberExpression:
+			e.span = Span{}
+			return e
+		case IndexExpression:
+			e.span = Span{}
+			return e
+		case CallExpression:
+			e.span = Span{}
+			return e
+		case UnaryExpression:
+			e.span = Span{}
+			return e
+		case BinaryExpression:
+			e.span = Span{}
+			return e
+		case ConditionalExpression:
+			e.span = Span{}
+			return e
+		}
+		return e
+	})
+}
+
+func TestFormat(t *testing.T) {
+
+	testCases := []struct {
+		expression string
+		expected   string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"((a))", "a"},
+		{"a - (b - c)", "a - (b - c)"},
+		{"(a - b) - c", "a - b - c"},
+		{"2 ** (3 ** 2)", "2 ** 3 ** 2"},
+		{"(2 ** 3) ** 2", "(2 ** 3) ** 2"},
+		{"-0x8000_0000_0000_0000 * 2", "-9223372036854775808 * 2"},
+		{"(-9223372036854775808) ** 2", "(-9223372036854775808) ** 2"},
+		{"-2 ** 2", "-2 ** 2"},
+		{"(-2) ** 2", "(-2) ** 2"},
+		{"2 ** (-1)", "2 ** -1"},
+		{"a ** -b ** c", "a ** -b ** c"},
+		{"a ** (-b ** c)", "a ** -b ** c"},
+		{"a ** (-b) ** c", "a ** (-b) ** c"},
+		{"- (a + b)", "-(a + b)"},
+		{"!!a", "!!a"},
+		{"- -1", "--1"},
+		{"a&&b||c&&!d", "a && b || c && !d"},
+		{"a && (b || c)", "a && (b || c)"},
+		{"a ?? b ?? c", "a ?? b ?? c"},
+		{"(a ?? b) ?? c", "(a ?? b) ?? c"},
+		{"a ?b: c", "a ? b : c"},
+		{"a ? b : c ? d : e", "a ? b : c ? d : e"},
+		{"a ? (b ? c : d) : e", "a ? (b ? c : d) : e"},
+		{"(a ? b : c) ? d : e", "(a ? b : c) ? d : e"},
+		{"(a ? b : c) + 1", "(a ? b : c) + 1"},
+		{"a in [1,2,  3]", "a in [1, 2, 3]"},
+		{"{ 'a' :1,\"b\":[] }", "{'a': 1, 'b': []}"},
+		{"{(a ? 'b' : 'c'): 1}", "{(a ? 'b' : 'c'): 1}"},
+		{"f( a,b )+g()", "f(a, b) + g()"},
+		{"a.b?.c[0].d", "a.b?.c[0].d"},
+		{"(a + b).c", "(a + b).c"},
+		{"(1).a", "(1).a"},
+		{"(-a)[0]", "(-a)[0]"},
+		{"[1, 2][0]", "[1, 2][0]"},
+		{"1.50 + 2.0", "1.5 + 2.0"},
+		{"0xff + 1_000 + .5 + 1E3 + 1e-9", "255 + 1000 + 0.5 + 1000.0 + 1e-09"},
+		{"99999999999999999999", "100000000000000000000.0"},
+		{`"it's"`, `"it's"`},
+		{"`a'\"b`", `'a\'"b'`},
+		{"`a\\b\n`", `'a\\b\n'`},
+		{"'\\u00e9\\x00'", `'é\x00'`},
+		{"name match \"^[a-z]+$\"", "name match '^[a-z]+$'"},
+		{"a&b|c^d<<1&^e", "a & b | c ^ d << 1 &^ e"},
+	}
+
+	for _, tc := range testCases {
+		exp, err := Parse(tc.expression)
+		if err != nil {
+			t.Errorf("unexpected error %v for %s", err, tc.expression)
+			continue
+		}
+		s := Format(exp)
+		if s != tc.expected {
+			t.Errorf("invalid format of %s. Expected %s, got %s", tc.expression, tc.expected, s)
+		}
+		if str := fmt.Sprint(exp); str != s {
+			t.Errorf("String() differs from Format for %s: %s", tc.expression, str)
+		}
+		parsed, err := Parse(s)
+		if err != nil {
+			t.Errorf("unexpected error %v parsing %s", err, s)
+			continue
+		}
+		if !reflect.DeepEqual(withoutSpans(parsed), withoutSpans(exp)) {
+			t.Errorf("%s does not round-trip: got %#v", s, withoutSpans(parsed))
+		}
+	}
+
+	//Built trees are rendered as well, with the parentheses they need
+	built := []struct {
+		expression Expression
+		expected   string
+	}{
+		{BinaryExpression{Operator: "-", Left: IntLiteral{Value: 1}, Right: IntLiteral{Value: -2}}, "1 - -2"},
+		{BinaryExpression{Operator: "**", Left: IntLiteral{Value: -2}, Right: IntLiteral{Value: 2}}, "(-2) ** 2"},
+		{BinaryExpression{Operator: "**", Left: IntLiteral{Value: 2}, Right: IntLiteral{Value: -1}}, "2 ** -1"},
+		{MemberExpression{Object: FloatLiteral{Value: 2}, Name: "a"}, "(2.0).a"},
+		{BinaryExpression{Operator: "+", Left: FloatLiteral{Value: math.Inf(-1)}, Right: FloatLiteral{Value: 1e21}}, "(-1.0 / 0.0) + 1e+21"},
+		{ListLiteral{Items: []Expression{FloatLiteral{Value: 1e20}, FloatLiteral{Value: 2.5e-7}, FloatLiteral{Value: 0.0001}}}, "[100000000000000000000.0, 2.5e-07, 0.0001]"},
+		{StringLiteral{Value: "a'b\"c`d\t\xff"}, `'a\'b"c` + "`" + `d\t\xff'`},
+	}
+	for _, tc := range built {
+		s := Format(tc.expression)
+		if s != tc.expected {
+			t.Errorf("invalid format. Expected %s, got %s", tc.expected, s)
+		}
+		r, err := Evaluate(tc.expression, variables(nil))
+		if err != nil {
+			continue
+		}
+		if v, err := Eval(s, nil); err != nil || !reflect.DeepEqual(v, r) {
+			t.Errorf("%s evaluates to %v, %v instead of %v", s, v, err, r)
+		}
+	}
+}
+
+//constantExpression is an expression not built by the parser
+type constantExpression struct{ value interface{} }
+
+func (e constantExpression) Eval(c Context) (interface{}, error) { return e.value, nil }
+
+func TestJSON(t *testing.T) {
+
+	expressions := []string{
+		"1 + 2 * -3",
+		"a.b?.c[0] >= 1.5 && !(d in [1, 'x', 2.5e-7, true])",
+		"f() + g(a, {'k': [nil], 1: {}})",
+		"name match '^[a-z]+$' ? x ?? y : -(z ** 2)",
+		"\"it's\" + `\"`",
+		"[]",
+	}
+	for _, s := range expressions {
+		exp, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(Tree{exp})
+		if err != nil {
+			t.Errorf("unexpected error %v encoding %s", err, s)
+			continue
+		}
+		var tree Tree
+		if err := json.Unmarshal(data, &tree); err != nil {
+			t.Errorf("unexpected error %v decoding %s", err, data)
+			continue
+		}
+		if !reflect.DeepEqual(withoutSpans(tree.Expression), withoutSpans(exp)) {
+			t.Errorf("%s does not round-trip: got %s", s, Format(tree.Expression))
+		}
+	}
+
+	data, err := json.Marshal(Tree{BinaryExpression{Operator: "==", Left: Identifier{Name: "a"}, Right: FloatLiteral{Value: math.Inf(1)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"version":1,"expression":{"type":"binary","operator":"==","left":{"type":"identifier","name":"a"},"right":{"type":"float","value":"+Inf"}}}`
+	if string(data) != expected {
+		t.Errorf("invalid encoding. Expected %s, got %s", expected, data)
+	}
+	//A string that is not valid UTF-8 is encoded by its bytes
+	parsed, err := Parse("'a\\xffb\\xc3' + \"\\u00e9\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []Expression{String("\xff"), parsed} {
+		data, err := json.Marshal(Tree{exp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tree Tree
+		if err := json.Unmarshal(data, &tree); err != nil {
+			t.Errorf("unexpected error %v decoding %s", err, data)
+		} else if !reflect.DeepEqual(withoutSpans(tree.Expression), withoutSpans(exp)) {
+			t.Errorf("%s does not round-trip: got %s", data, Format(tree.Expression))
+		}
+	}
+	if data, err := json.Marshal(String("\xff")); err != nil || string(data) != `{"type":"string","bytes":"/w=="}` {
+		t.Errorf("invalid encoding of a string that is not valid UTF-8: %s, %v", data, err)
+	}
+	if data, err := json.Marshal(IntLiteral{Value: 0}); err != nil || string(data) != `{"type":"int","value":0}` {
+		t.Errorf("invalid encoding of a node: %s, %v", data, err)
+	}
+	if _, err := json.Marshal(Tree{ListLiteral{Items: []Expression{constantExpression{1}}}}); err == nil || !strings.Contains(err.Error(), "expression.items[0]: cannot encode expression of type gript.constantExpression") {
+		t.Errorf("invalid error encoding a custom node: %v", err)
+	}
+
+	invalid := []struct {
+		json  string
+		error string
+	}{
+		{`{"expression":{"type":"int","value":1}}`, "version: unsupported schema version 0"},
+		{`{"version":2,"expression":{"type":"int","value":1}}`, "version: unsupported schema version 2"},
+		{`{"version":1}`, "expression: missing expression"},
+		{`{"version":1,"expression":{"type":"int","value":1.5}}`, "expression: invalid int value 1.5"},
+		{`{"version":1,"expression":{"type":"float"}}`, "expression: missing float value"},
+		{`{"version":1,"expression":{"type":"float","value":"Infinity"}}`, `expression: invalid float value "Infinity"`},
+		{`{"version":1,"expression":{"type":"string","value":1}}`, "expression: invalid string value 1"},
+		{`{"version":1,"expression":{"type":"string"}}`, "expression: missing string value"},
+		{`{"version":1,"expression":{"type":"string","value":"a","bytes":"/w=="}}`, "expression: both value and bytes of string"},
+		{`{"version":1,"expression":{"type":"pattern","value":"("}}`, "expression: invalid regular expression: error parsing regexp: missing closing ): `(`"},
+		{`{"version":1,"expression":{"type":"identifier","name":"a.b"}}`, "expression: invalid identifier 'a.b'"},
+		{`{"version":1,"expression":{"type":"member","name":"in","object":{"type":"identifier","name":"a"}}}`, "expression: invalid member name 'in'"},
+		{`{"version":1,"expression":{"type":"call","function":"1f"}}`, "expression: invalid function name '1f'"},
+		{`{"version":1,"expression":{"type":"unary","operator":"~","operand":{"type":"int","value":1}}}`, "expression: invalid unary operator '~'"},
+		{`{"version":1,"expression":{"type":"binary","operator":"?","left":{"type":"int","value":1},"right":{"type":"int","value":1}}}`, "expression: invalid binary operator '?'"},
+		{`{"version":1,"expression":{"type":"binary","operator":"+","left":{"type":"int","value":1}}}`, "expression.right: missing expression"},
+		{`{"version":1,"expression":{"type":"list","items":[{"type":"int","value":1},{"type":"lambda"}]}}`, "expression.items[1]: unknown expression type 'lambda'"},
+		{`{"version":1,"expression":{"type":"map","entries":[{"key":{"type":"string","value":"a"}}]}}`, "expression.entries[0].value: missing expression"},
+		{`{"version":1,"expression":{"type":"conditional","condition":{"type":"identifier","name":"a"},"yes":{"type":"int","value":1},"no":{"type":"x"}}}`, "expression.no: unknown expression type 'x'"},
+		{`{"version":1,"expression":{"type":"int","value":1,"span":{}}}`, `json: unknown field "span"`},
+	}
+	for _, tc := range invalid {
+		var tree Tree
+		err := json.Unmarshal([]byte(tc.json), &tree)
+		if err == nil || err.Error() != tc.error {
+			t.Errorf("invalid error decoding %s. Expected %s, got %v", tc.json, tc.error, err)
+		}
+		var se *SchemaError
+		if err != nil && !strings.HasPrefix(err.Error(), "json:") && !errors.As(err, &se) {
+			t.Errorf("expecting a *SchemaError decoding %s, got %T", tc.json, err)
+		}
+	}
+}
+
+//mustVar returns the variable of a valid path
+func mustVar(path string) Expression {
+	e, err := Var(path)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+//mustBinary returns the binary operation of a valid operator
+func mustBinary(operator string, l, r Expression) Expression {
+	e, err := Binary(operator, l, r)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func TestBuilder(t *testing.T) {
+
+	testCases := []struct {
+		built    Expression
+		expected string
+	}{
+		{And(Gt(mustVar("a"), Int(4)), Eq(mustVar("user.name"), String("it's"))), `a > 4 && user.name == "it's"`},
+		{Or(mustVar("a"), mustVar("b"), Not(mustVar("c"))), "a || b || !c"},
+		{Mul(Add(Int(1), Int(2)), Int(-3)), "(1 + 2) * -3"},
+		{Sub(mustVar("a"), Sub(mustVar("b"), Float(-0.5))), "a - (b - -0.5)"},
+		{Pow(Neg(mustVar("a")), Int(2)), "(-a) ** 2"},
+		{Cond(In(mustVar("a"), List(Int(1), Bool(true), Nil())), Div(mustVar("a"), Int(2)), Mod(mustVar("b"), Int(2))), "a in [1, true, nil] ? a / 2 : b % 2"},
+		{Coalesce(OptionalMember(Member(mustVar("a"), "b"), "c"), Index(mustVar("l"), Int(0))), "a.b?.c ?? l[0]"},
+		{Ge(Call("len", mustVar("s")), Call("now")), "len(s) >= now()"},
+		{Ne(Map(Entry(String("k"), List()), Entry(Int(1), String(`"`))), Le(mustVar("x"), Lt(mustVar("y"), mustVar("z")))), `{'k': [], 1: '"'} != x <= (y < z)`},
+		{Match(mustVar("name"), String("^[a-z]+$")), "name match '^[a-z]+$'"},
+		{mustBinary("&^", mustVar("a"), mustVar("b")), "a &^ b"},
+		{mustVar("req.headers.x-request-id.in"), "req.headers['x-request-id']['in']"},
+	}
+
+	for _, tc := range testCases {
+		s := Format(tc.built)
+		if s != tc.expected {
+			t.Errorf("invalid format. Expected %s, got %s", tc.expected, s)
+			continue
+		}
+		parsed, err := Parse(s)
+		if err != nil {
+			t.Errorf("unexpected error %v parsing %s", err, s)
+			continue
+		}
+		if !reflect.DeepEqual(withoutSpans(tc.built), withoutSpans(parsed)) {
+			t.Errorf("the tree built for %s differs from the parsed one: %#v", s, withoutSpans(tc.built))
+		}
+	}
+
+	p, err := CompileExpression(And(Gt(mustVar("a"), Int(4)), Eq(mustVar("user.name"), String("it's"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.Eval(map[string]interface{}{"a": 5, "user": map[string]interface{}{"name": "it's"}}); err != nil || r != true {
+		t.Errorf("expecting true, got %v, %v", r, err)
+	}
+	if _, err := CompileExpression(Match(mustVar("name"), String("("))); err == nil {
+		t.Errorf("expecting an error compiling an invalid pattern")
+	}
+
+	v, err := Value(map[string]interface{}{"b": []interface{}{1.5, int64(-2), "x"}, "a": map[string]bool{"t": true}, "c": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := Format(v); s != "{'a': {'t': true}, 'b': [1.5, -2, 'x'], 'c': nil}" {
+		t.Errorf("invalid value literal %s", s)
+	}
+	if _, err := Value(struct{}{}); err == nil {
+		t.Errorf("expecting an error for a struct value")
+	}
+	if v, err := Value([]uint64{math.MaxUint64, 3}); err != nil || Format(v) != "[18446744073709552000.0, 3]" {
+		t.Errorf("invalid unsigned value literal %v, %v", v, err)
+	}
+
+	for _, path := range []string{"x-request-id", "", ".a", "in.a", "a.", "a..b", "."} {
+		if _, err := Var(path); err == nil {
+			t.Errorf("expecting an error for the invalid variable path '%s'", path)
+		}
+	}
+	for _, operator := range []string{"=", "?", "?:", "!", ""} {
+		if _, err := Binary(operator, mustVar("a"), Int(1)); err == nil {
+			t.Errorf("expecting an error for the invalid binary operator '%s'", operator)
+		}
+	}
+}
+
+func TestProgramConcurrentRun(t *testing.T) {
+
+	p, err := Compile("a > 4 || (a < 2 && a > 0) ? [a, 'x'][0] * 2 : -a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				a := g*100 + i
+				expected := -a
+				if a > 4 || a == 1 {
+					expected = 2 * a
+				}
+				result, err := p.Eval(map[string]interface{}{"a": a})
+				if err != nil || result != expected {
+					t.Errorf("a=%d : expecting %d, got %v, %v", a, expected, result, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
 var result interface{}
 
 func BenchmarkEvalBasic(b *testing.B) {
@@ -255,3 +1879,48 @@ func BenchmarkEvalComplex(b *testing.B) {
 	}
 	result = r
 }
+
+func BenchmarkProgramBasic(b *testing.B) {
+	p, _ := Compile("1")
+	var r interface{}
+	for n := 0; n < b.N; n++ {
+		r, _ = p.Eval(nil)
+	}
+	result = r
+}
+func BenchmarkProgramComplex(b *testing.B) {
+	p, _ := Compile("a > 4 || (a < 2 && a > 0)")
+	values := map[string]interface{}{"a": 1}
+	var r interface{}
+	for n := 0; n < b.N; n++ {
+		r, _ = p.Eval(values)
+	}
+	result = r
+}
+func BenchmarkProgramComplexParallel(b *testing.B) {
+	p, _ := Compile("a > 4 || (a < 2 && a > 0)")
+	b.RunParallel(func(pb *testing.PB) {
+		values := map[string]interface{}{"a": 1}
+		for pb.Next() {
+			p.Eval(values)
+		}
+	})
+}
+func BenchmarkProgramConstants(b *testing.B) {
+	p, _ := Compile("ab > 3+1 || (ab < 4-2 && ab > 6%2) || name match '^a+b'")
+	values := map[string]interface{}{"ab": 3, "name": "aab"}
+	var r interface{}
+	for n := 0; n < b.N; n++ {
+		r, _ = p.Eval(values)
+	}
+	result = r
+}
+func BenchmarkProgramDynamicMatch(b *testing.B) {
+	p, _ := Compile("name match prefix + '.*b$'")
+	values := map[string]interface{}{"name": "aab", "prefix": "^a"}
+	var r interface{}
+	for n := 0; n < b.N; n++ {
+		r, _ = p.Eval(values)
+	}
+	result = r
+}
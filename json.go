@@ -0,0 +1,400 @@
+package gript
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+//SchemaVersion is the version of the JSON schema of the expression trees written by Tree.MarshalJSON
+const SchemaVersion = 1
+
+//Tree holds an expression tree to encode it in JSON, or to decode it from JSON, along with the version of its schema:
+//
+// {"version": 1, "expression": {"type": "binary", "operator": ">", "left": {"type": "identifier", "name": "a"}, "right": {"type": "int", "value": 4}}}
+//
+//The nodes are objects with a "type" among "int", "float", "string", "pattern", "identifier", "list", "map",
+//"member", "index", "call", "unary", "binary" and "conditional", and the fields of the node type.
+//A string that is not valid UTF-8, that a JSON string cannot hold, has its bytes encoded in base64 in a "bytes" field
+//instead of its "value", as {"type": "string", "bytes": "/w=="} for '\xff'. The spans of the nodes are not encoded.
+type Tree struct {
+	Expression Expression
+}
+
+//MarshalJSON encodes the expression tree, failing with a *SchemaError for a node that is not built by Parse
+func (t Tree) MarshalJSON() ([]byte, error) {
+	n, err := encode(t.Expression, "expression")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonTree{Version: SchemaVersion, Expression: n})
+}
+
+//UnmarshalJSON decodes an expression tree, failing with a *SchemaError when the tree is not valid for its schema version
+func (t *Tree) UnmarshalJSON(data []byte) error {
+
+	var tree jsonTree
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&tree); err != nil {
+		return err
+	}
+	if tree.Version < 1 || tree.Version > SchemaVersion {
+		return &SchemaError{Path: "version", Msg: fmt.Sprintf("unsupported schema version %d", tree.Version)}
+	}
+
+	e, err := decode(tree.Expression, "expression")
+	if err != nil {
+		return err
+	}
+	t.Expression = e
+	return nil
+}
+
+func (e IntLiteral) MarshalJSON() ([]byte, error)            { return marshal(e) }
+func (e FloatLiteral) MarshalJSON() ([]byte, error)          { return marshal(e) }
+func (e StringLiteral) MarshalJSON() ([]byte, error)         { return marshal(e) }
+func (e PatternLiteral) MarshalJSON() ([]byte, error)        { return marshal(e) }
+func (e Identifier) MarshalJSON() ([]byte, error)            { return marshal(e) }
+func (e ListLiteral) MarshalJSON() ([]byte, error)           { return marshal(e) }
+func (e MapLiteral) MarshalJSON() ([]byte, error)            { return marshal(e) }
+func (e MemberExpression) MarshalJSON() ([]byte, error)      { return marshal(e) }
+func (e IndexExpression) MarshalJSON() ([]byte, error)       { return marshal(e) }
+func (e CallExpression) MarshalJSON() ([]byte, error)        { return marshal(e) }
+func (e UnaryExpression) MarshalJSON() ([]byte, error)       { return marshal(e) }
+func (e BinaryExpression) MarshalJSON() ([]byte, error)      { return marshal(e) }
+func (e ConditionalExpression) MarshalJSON() ([]byte, error) { return marshal(e) }
+
+//marshal encodes a node, without the version of the schema
+func marshal(e Expression) ([]byte, error) {
+	n, err := encode(e, "expression")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
+
+//jsonTree is the JSON encoding of a Tree
+type jsonTree struct {
+	Version    int       `json:"version"`
+	Expression *jsonNode `json:"expression"`
+}
+
+//jsonNode is the JSON encoding of a node, holding the fields of every node type
+type jsonNode struct {
+	Type      string          `json:"type"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Bytes     []byte          `json:"bytes,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Function  string          `json:"function,omitempty"`
+	Operator  string          `json:"operator,omitempty"`
+	Optional  bool            `json:"optional,omitempty"`
+	Object    *jsonNode       `json:"object,omitempty"`
+	Index     *jsonNode       `json:"index,omitempty"`
+	Operand   *jsonNode       `json:"operand,omitempty"`
+	Left      *jsonNode       `json:"left,omitempty"`
+	Right     *jsonNode       `json:"right,omitempty"`
+	Condition *jsonNode       `json:"condition,omitempty"`
+	Yes       *jsonNode       `json:"yes,omitempty"`
+	No        *jsonNode       `json:"no,omitempty"`
+	Items     []*jsonNode     `json:"items,omitempty"`
+	Args      []*jsonNode     `json:"args,omitempty"`
+	Entries   []jsonEntry     `json:"entries,omitempty"`
+}
+
+type jsonEntry struct {
+	Key   *jsonNode `json:"key"`
+	Value *jsonNode `json:"value"`
+}
+
+//SchemaError is returned when an expression tree cannot be encoded in JSON, or when a decoded tree is invalid
+type SchemaError struct {
+	Path string //Location of the invalid node in the tree, as 'expression.left.args[0]'
+	Msg  string //Message describing the error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+//encode converts a node to its JSON encoding, path being its location in the tree
+func encode(e Expression, path string) (*jsonNode, error) {
+
+	var err error
+	var n *jsonNode
+	switch e := e.(type) {
+	case IntLiteral:
+		n = &jsonNode{Type: "int", Value: json.RawMessage(strconv.Itoa(e.Value))}
+	case FloatLiteral:
+		n = &jsonNode{Type: "float", Value: encodeFloat(e.Value)}
+	case StringLiteral:
+		n = &jsonNode{Type: "string"}
+		err = n.encodeString(e.Value)
+	case PatternLiteral:
+		n = &jsonNode{Type: "pattern"}
+		err = n.encodeString(e.Regexp.String())
+	case Identifier:
+		n = &jsonNode{Type: "identifier", Name: e.Name}
+	case ListLiteral:
+		n = &jsonNode{Type: "list"}
+		n.Items, err = encodeAll(e.Items, path+".items")
+	case MapLiteral:
+		n = &jsonNode{Type: "map"}
+		for i, entry := range e.Entries {
+			var je jsonEntry
+			if je.Key, err = encode(entry.Key, fmt.Sprintf("%s.entries[%d].key", path, i)); err != nil {
+				return nil, err
+			}
+			if je.Value, err = encode(entry.Value, fmt.Sprintf("%s.entries[%d].value", path, i)); err != nil {
+				return nil, err
+			}
+			n.Entries = append(n.Entries, je)
+		}
+	case MemberExpression:
+		n = &jsonNode{Type: "member", Name: e.Name, Optional: e.Optional}
+		n.Object, err = encode(e.Object, path+".object")
+	case IndexExpression:
+		n = &jsonNode{Type: "index"}
+		if n.Object, err = encode(e.Object, path+".object"); err == nil {
+			n.Index, err = encode(e.Index, path+".index")
+		}
+	case CallExpression:
+		n = &jsonNode{Type: "call", Function: e.Function}
+		n.Args, err = encodeAll(e.Args, path+".args")
+	case UnaryExpression:
+		n = &jsonNode{Type: "unary", Operator: e.Operator}
+		n.Operand, err = encode(e.Operand, path+".operand")
+	case BinaryExpression:
+		n = &jsonNode{Type: "binary", Operator: e.Operator}
+		if n.Left, err = encode(e.Left, path+".left"); err == nil {
+			n.Right, err = encode(e.Right, path+".right")
+		}
+	case ConditionalExpression:
+		n = &jsonNode{Type: "conditional"}
+		if n.Condition, err = encode(e.Condition, path+".condition"); err == nil {
+			if n.Yes, err = encode(e.Yes, path+".yes"); err == nil {
+				n.No, err = encode(e.No, path+".no")
+			}
+		}
+	default:
+		return nil, &SchemaError{Path: path, Msg: fmt.Sprintf("cannot encode expression of type %T", e)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func encodeAll(expressions []Expression, path string) ([]*jsonNode, error) {
+	var nodes []*jsonNode
+	for i, e := range expressions {
+		n, err := encode(e, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+//encodeString sets the value of a string or a pattern node, or its bytes when the string is not valid UTF-8:
+//json.Marshal would replace its invalid bytes
+func (n *jsonNode) encodeString(s string) (err error) {
+	if !utf8.ValidString(s) {
+		n.Bytes = []byte(s)
+		return nil
+	}
+	n.Value, err = json.Marshal(s)
+	return err
+}
+
+//encodeFloat encodes a float as a JSON number, or as one of the strings "+Inf", "-Inf" and "NaN"
+func encodeFloat(f float64) json.RawMessage {
+	switch {
+	case math.IsInf(f, 1):
+		return json.RawMessage(`"+Inf"`)
+	case math.IsInf(f, -1):
+		return json.RawMessage(`"-Inf"`)
+	case math.IsNaN(f):
+		return json.RawMessage(`"NaN"`)
+	}
+	return json.RawMessage(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+//decode converts the JSON encoding of a node to the node, path being its location in the tree
+func decode(n *jsonNode, path string) (Expression, error) {
+
+	if n == nil {
+		return nil, &SchemaError{Path: path, Msg: "missing expression"}
+	}
+	invalid := func(format string, a ...interface{}) error {
+		return &SchemaError{Path: path, Msg: fmt.Sprintf(format, a...)}
+	}
+
+	switch n.Type {
+	case "int", "float":
+		if len(n.Value) == 0 {
+			return nil, invalid("missing %s value", n.Type)
+		}
+	case "string", "pattern":
+		if len(n.Value) == 0 && n.Bytes == nil {
+			return nil, invalid("missing %s value", n.Type)
+		}
+		if len(n.Value) != 0 && n.Bytes != nil {
+			return nil, invalid("both value and bytes of %s", n.Type)
+		}
+	}
+
+	switch n.Type {
+	case "int":
+		i, err := strconv.Atoi(string(n.Value))
+		if err != nil {
+			return nil, invalid("invalid int value %s", n.Value)
+		}
+		return IntLiteral{Value: i}, nil
+	case "float":
+		var f float64
+		if err := json.Unmarshal(n.Value, &f); err != nil {
+			var s string
+			if json.Unmarshal(n.Value, &s) != nil || (s != "+Inf" && s != "-Inf" && s != "NaN") {
+				return nil, invalid("invalid float value %s", n.Value)
+			}
+			f, _ = strconv.ParseFloat(s, 64)
+		}
+		return FloatLiteral{Value: f}, nil
+	case "string", "pattern":
+		s := string(n.Bytes)
+		if n.Bytes == nil {
+			if err := json.Unmarshal(n.Value, &s); err != nil {
+				return nil, invalid("invalid %s value %s", n.Type, n.Value)
+			}
+		}
+		if n.Type == "string" {
+			return StringLiteral{Value: s}, nil
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, invalid("invalid regular expression: %s", err)
+		}
+		return PatternLiteral{Regexp: re}, nil
+	case "identifier":
+		if !isIdentifier(n.Name) {
+			return nil, invalid("invalid identifier '%s'", n.Name)
+		}
+		return Identifier{Name: n.Name}, nil
+	case "list":
+		items, err := decodeAll(n.Items, path+".items")
+		if err != nil {
+			return nil, err
+		}
+		return ListLiteral{Items: items}, nil
+	case "map":
+		m := MapLiteral{}
+		for i, entry := range n.Entries {
+			key, err := decode(entry.Key, fmt.Sprintf("%s.entries[%d].key", path, i))
+			if err != nil {
+				return nil, err
+			}
+			value, err := decode(entry.Value, fmt.Sprintf("%s.entries[%d].value", path, i))
+			if err != nil {
+				return nil, err
+			}
+			m.Entries = append(m.Entries, MapEntry{Key: key, Value: value})
+		}
+		return m, nil
+	case "member":
+		if !isIdentifier(n.Name) {
+			return nil, invalid("invalid member name '%s'", n.Name)
+		}
+		object, err := decode(n.Object, path+".object")
+		if err != nil {
+			return nil, err
+		}
+		return MemberExpression{Object: object, Name: n.Name, Optional: n.Optional}, nil
+	case "index":
+		object, err := decode(n.Object, path+".object")
+		if err != nil {
+			return nil, err
+		}
+		i, err := decode(n.Index, path+".index")
+		if err != nil {
+			return nil, err
+		}
+		return IndexExpression{Object: object, Index: i}, nil
+	case "call":
+		if !isIdentifier(n.Function) {
+			return nil, invalid("invalid function name '%s'", n.Function)
+		}
+		args, err := decodeAll(n.Args, path+".args")
+		if err != nil {
+			return nil, err
+		}
+		return CallExpression{Function: n.Function, Args: args}, nil
+	case "unary":
+		if !isUnaryOperator(n.Operator) {
+			return nil, invalid("invalid unary operator '%s'", n.Operator)
+		}
+		operand, err := decode(n.Operand, path+".operand")
+		if err != nil {
+			return nil, err
+		}
+		return UnaryExpression{Operator: n.Operator, Operand: operand}, nil
+	case "binary":
+		if precedence(n.Operator) <= precedence("?") {
+			return nil, invalid("invalid binary operator '%s'", n.Operator)
+		}
+		left, err := decode(n.Left, path+".left")
+		if err != nil {
+			return nil, err
+		}
+		right, err := decode(n.Right, path+".right")
+		if err != nil {
+			return nil, err
+		}
+		return BinaryExpression{Operator: n.Operator, Left: left, Right: right}, nil
+	case "conditional":
+		condition, err := decode(n.Condition, path+".condition")
+		if err != nil {
+			return nil, err
+		}
+		yes, err := decode(n.Yes, path+".yes")
+		if err != nil {
+			return nil, err
+		}
+		no, err := decode(n.No, path+".no")
+		if err != nil {
+			return nil, err
+		}
+		return ConditionalExpression{Condition: condition, Yes: yes, No: no}, nil
+	}
+	return nil, invalid("unknown expression type '%s'", n.Type)
+}
+
+func decodeAll(nodes []*jsonNode, path string) ([]Expression, error) {
+	expressions := make([]Expression, 0, len(nodes))
+	for i, n := range nodes {
+		e, err := decode(n, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, e)
+	}
+	return expressions, nil
+}
+
+//isIdentifier is true for a name that is scanned as an identifier
+func isIdentifier(name string) bool {
+	if name == "" || name == "in" || name == "match" {
+		return false
+	}
+	for i, ch := range name {
+		if !isLetter(ch) && (i == 0 || (!isDigit(ch) && ch != '_')) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package gript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+//Limits bound the cost of running a program. A zero limit stands for no limit.
+type Limits struct {
+	MaxSteps          int //Maximum number of evaluation steps, one per node of the expression tree evaluated
+	MaxDepth          int //Maximum depth of the expression tree, checked at compile time
+	MaxStringLength   int //Maximum length in bytes of the strings produced by the evaluation
+	MaxCollectionSize int //Maximum number of elements of the lists and maps produced by the evaluation
+	MaxMatchLength    int //Maximum length in bytes of the strings matched against a regular expression
+}
+
+//WithLimits bounds the cost of running the program. The values of the constant parts evaluated by the compilation
+//are bounded too, exceeding a limit failing the compilation.
+func WithLimits(limits Limits) Option {
+	return func(p *Program) {
+		p.limits = limits
+	}
+}
+
+//Errors wrapped by a *LimitError, telling which limit is exceeded
+var (
+	ErrStepLimit       = errors.New("evaluation step limit exceeded")
+	ErrDepthLimit      = errors.New("expression depth limit exceeded")
+	ErrStringLimit     = errors.New("string length limit exceeded")
+	ErrCollectionLimit = errors.New("collection size limit exceeded")
+	ErrMatchLimit      = errors.New("match input length limit exceeded")
+)
+
+//LimitError is returned when running a program exceeds one of its limits. Err is one of ErrStepLimit, ErrDepthLimit,
+//ErrStringLimit, ErrCollectionLimit and ErrMatchLimit.
+type LimitError struct {
+	located
+	Err error
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s (limit %d)", e.Err, e.Max)
+}
+
+//Unwrap returns the error telling which limit is exceeded
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+//cancellationInterval is the number of steps between two checks of the cancellation of the evaluation
+const cancellationInterval = 64
+
+//guard enforces the cancellation of a context and the limits of a program while running it
+type guard struct {
+	ctx    context.Context
+	limits Limits
+	steps  int
+}
+
+//step counts the evaluation step of the expression at span, checking the cancellation of the context from time to time
+func (g *guard) step(span Span) error {
+	g.steps++
+	if g.limits.MaxSteps > 0 && g.steps > g.limits.MaxSteps {
+		return &LimitError{located{span}, ErrStepLimit, g.limits.MaxSteps}
+	}
+	if g.steps%cancellationInterval == 0 {
+		return g.ctx.Err()
+	}
+	return nil
+}
+
+//produced checks the size of a string, a list or a map produced by the evaluation
+func (g *guard) produced(v interface{}) error {
+
+	if s, ok := v.(string); ok {
+		if g.limits.MaxStringLength > 0 && len(s) > g.limits.MaxStringLength {
+			return &LimitError{Err: ErrStringLimit, Max: g.limits.MaxStringLength}
+		}
+		return nil
+	}
+	if g.limits.MaxCollectionSize > 0 {
+		switch value := reflect.ValueOf(v); value.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map:
+			if value.Len() > g.limits.MaxCollectionSize {
+				return &LimitError{Err: ErrCollectionLimit, Max: g.limits.MaxCollectionSize}
+			}
+		}
+	}
+	return nil
+}
+
+//matched checks the length of a string matched against a regular expression
+func (g *guard) matched(v interface{}) error {
+	if s, ok := v.(string); ok && g.limits.MaxMatchLength > 0 && len(s) > g.limits.MaxMatchLength {
+		return &LimitError{Err: ErrMatchLimit, Max: g.limits.MaxMatchLength}
+	}
+	return nil
+}
+
+//guardOf returns the guard of the program run against c, nil when the run is not guarded
+func guardOf(c Context) *guard {
+	if pc, ok := c.(programContext); ok {
+		return pc.guard
+	}
+	return nil
+}
+
+//step counts the evaluation of the expression at span, when the run is guarded
+func step(c Context, span Span) error {
+	if pc, ok := c.(programContext); ok && pc.guard != nil {
+		return pc.guard.step(span)
+	}
+	return nil
+}
+
+//produced checks the size of a value produced by the expression at span, when the run is guarded
+func produced(c Context, v interface{}, span Span) error {
+	if g := guardOf(c); g != nil {
+		return locate(g.produced(v), span)
+	}
+	return nil
+}
+
+//nested returns a sub-expression nested deeper than max levels in an expression tree, a literal having a depth of 1,
+//or nil if the tree is not deeper than max
+func nested(e Expression, max int) Expression {
+	if max == 0 {
+		return e
+	}
+	for _, child := range children(e) {
+		if n := nested(child, max-1); n != nil {
+			return n
+		}
+	}
+	return nil
+}
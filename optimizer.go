@@ -0,0 +1,266 @@
+package gript
+
+import "regexp"
+
+//optimizer simplifies an expression before it is compiled, evaluating its constant parts once and for all
+type optimizer struct {
+	context Context //context in which constant parts are evaluated, without any variable
+}
+
+//optimize folds the constant sub-expressions of an expression, removes the identities of the logical operators
+//and compiles the constant patterns of 'match' (the literal ones being compiled by the parser). The error of a constant sub-expression that would always be evaluated is returned.
+func optimize(e Expression, c Context) (Expression, error) {
+	o := optimizer{context: c}
+	return o.optimize(e)
+}
+
+//isConstant is true for the literals, including true, false and nil
+func isConstant(e Expression) bool {
+	switch e := e.(type) {
+	case IntLiteral, FloatLiteral, StringLiteral, PatternLiteral:
+		return true
+	case Identifier:
+		return e.Name == "true" || e.Name == "false" || e.Name == "nil"
+	}
+	return false
+}
+
+//isBoolean is true for the expressions that can only evaluate to a boolean
+func isBoolean(e Expression) bool {
+	switch e := e.(type) {
+	case Identifier:
+		return e.Name == "true" || e.Name == "false"
+	case UnaryExpression:
+		return e.Operator == "!"
+	case BinaryExpression:
+		switch e.Operator {
+		case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "in", "match":
+			return true
+		}
+	}
+	return false
+}
+
+//literal returns the literal giving a value, and false for values of other types than int, float64, string, bool or nil
+func literal(v interface{}, span Span) (Expression, bool) {
+	switch v := v.(type) {
+	case int:
+		return IntLiteral{v, span}, true
+	case float64:
+		return FloatLiteral{v, span}, true
+	case string:
+		return StringLiteral{v, span}, true
+	case bool:
+		if v {
+			return Identifier{"true", span}, true
+		}
+		return Identifier{"false", span}, true
+	case nil:
+		return Identifier{"nil", span}, true
+	}
+	return nil, false
+}
+
+//fold replaces an expression whose operands are constant by its value
+func (o *optimizer) fold(e Expression) (Expression, error) {
+	v, err := e.Eval(o.context)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := literal(v, spanOf(e)); ok {
+		return l, nil
+	}
+	return e, nil
+}
+
+//lazy optimizes an operand that may not be evaluated: an error keeps it as is, to be reported only when evaluated
+func (o *optimizer) lazy(e Expression) Expression {
+	optimized, err := o.optimize(e)
+	if err != nil {
+		return e
+	}
+	return optimized
+}
+
+func (o *optimizer) optimize(e Expression) (Expression, error) {
+
+	var err error
+	switch e := e.(type) {
+	case ListLiteral:
+		items := make([]Expression, len(e.Items))
+		for i, item := range e.Items {
+			if items[i], err = o.optimize(item); err != nil {
+				return nil, err
+			}
+		}
+		return ListLiteral{items, e.span}, nil
+	case MapLiteral:
+		entries := make([]MapEntry, len(e.Entries))
+		for i, entry := range e.Entries {
+			if entries[i].Key, err = o.optimize(entry.Key); err != nil {
+				return nil, err
+			}
+			if entries[i].Value, err = o.optimize(entry.Value); err != nil {
+				return nil, err
+			}
+		}
+		return MapLiteral{entries, e.span}, nil
+	case CallExpression:
+		args := make([]Expression, len(e.Args))
+		for i, arg := range e.Args {
+			if args[i], err = o.optimize(arg); err != nil {
+				return nil, err
+			}
+		}
+		return CallExpression{e.Function, args, e.span}, nil
+	case MemberExpression, IndexExpression:
+		optimized, _, err := o.chain(e)
+		return optimized, err
+	case UnaryExpression:
+		if e.Operand, err = o.optimize(e.Operand); err != nil {
+			return nil, err
+		}
+		if isConstant(e.Operand) {
+			return o.fold(e)
+		}
+		return e, nil
+	case ConditionalExpression:
+		if e.Condition, err = o.optimize(e.Condition); err != nil {
+			return nil, err
+		}
+		if isConstant(e.Condition) {
+			condition, err := e.Condition.Eval(o.context)
+			if err != nil {
+				return nil, err
+			}
+			switch condition {
+			case true:
+				return o.optimize(e.Yes)
+			case false:
+				return o.optimize(e.No)
+			}
+			return o.fold(e)
+		}
+		e.Yes, e.No = o.lazy(e.Yes), o.lazy(e.No)
+		return e, nil
+	case BinaryExpression:
+		return o.binary(e)
+	}
+	return e, nil
+}
+
+//chain optimizes a chain of member and index accesses, telling whether the error is the one of the chain itself,
+//as a missing member of a constant, rather than the one of an index or of an object that is not a chain
+func (o *optimizer) chain(e Expression) (optimized Expression, chained bool, err error) {
+	switch e := e.(type) {
+	case MemberExpression:
+		if _, ok := e.path(); ok {
+			//Keep the chain from a variable, reported as a whole when undefined
+			return e, false, nil
+		}
+		if e.Object, chained, err = o.chain(e.Object); err != nil {
+			return nil, chained, err
+		}
+		if isConstant(e.Object) && !e.Optional {
+			//An optional access is kept: a missing member makes the rest of its chain nil
+			optimized, err = o.fold(e)
+			return optimized, true, err
+		}
+		return e, false, nil
+	case IndexExpression:
+		if e.Object, chained, err = o.chain(e.Object); err != nil {
+			return nil, chained, err
+		}
+		if e.Index, err = o.optimize(e.Index); err != nil {
+			return nil, false, err
+		}
+		if isConstant(e.Object) && isConstant(e.Index) {
+			optimized, err = o.fold(e)
+			return optimized, true, err
+		}
+		return e, false, nil
+	}
+	optimized, err = o.optimize(e)
+	return optimized, false, err
+}
+
+func (o *optimizer) binary(e BinaryExpression) (Expression, error) {
+
+	var err error
+	var chained bool
+	if e.Operator == "??" && len(DependenciesOf(e.Left).Variables) > 0 {
+		//An undefined variable, evaluated first, may give the right part instead of a constant error
+		e.Left, e.Right = o.lazy(e.Left), o.lazy(e.Right)
+		return e, nil
+	}
+	if e.Left, chained, err = o.chain(e.Left); err != nil {
+		if e.Operator == "??" && chained && isUndefined(err) {
+			//The left part is always undefined
+			return o.optimize(e.Right)
+		}
+		return nil, err
+	}
+
+	switch e.Operator {
+	case "&&", "||":
+		//skip is the value of the left part skipping the right part: false for '&&' and true for '||'
+		skip, identity := "false", "true"
+		if e.Operator == "||" {
+			skip, identity = "true", "false"
+		}
+		left, ok := e.Left.(Identifier)
+		switch {
+		case ok && isConstant(left) && left.Name == skip:
+			return Identifier{left.Name, e.span}, nil
+		case isConstant(e.Left):
+			//The right part is always evaluated
+			if e.Right, err = o.optimize(e.Right); err != nil {
+				return nil, err
+			}
+			if ok && left.Name == identity && isBoolean(e.Right) {
+				//'true && x' and 'false || x' are x
+				return e.Right, nil
+			}
+		default:
+			e.Right = o.lazy(e.Right)
+			if right, ok := e.Right.(Identifier); ok && right.Name == identity && isBoolean(e.Left) {
+				//'x && true' and 'x || false' are x
+				return e.Left, nil
+			}
+		}
+	case "??":
+		if isConstant(e.Left) {
+			if v, _ := e.Left.Eval(o.context); v != nil {
+				return e.Left, nil
+			}
+			return o.optimize(e.Right)
+		}
+		e.Right = o.lazy(e.Right)
+		return e, nil
+	default:
+		if e.Right, err = o.optimize(e.Right); err != nil {
+			return nil, err
+		}
+	}
+
+	if isConstant(e.Left) && isConstant(e.Right) {
+		if e.Operator == "/" && !isStrictFloatDivision(o.context) {
+			l, _ := e.Left.Eval(o.context)
+			r, _ := e.Right.Eval(o.context)
+			if isFloatDivisionByZero(l, r) {
+				//Kept for the context the program is run against, that may make the division strict
+				return e, nil
+			}
+		}
+		return o.fold(e)
+	}
+
+	if right, ok := e.Right.(StringLiteral); ok && e.Operator == "match" {
+		pattern, err := regexp.Compile(right.Value)
+		if err != nil {
+			return nil, &InvalidOperationError{located{right.span}, "match", err.Error()}
+		}
+		e.Right = PatternLiteral{pattern, right.span}
+	}
+	return e, nil
+}
@@ -1,19 +1,23 @@
 package gript
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 // parser represents a parser.
 type parser struct {
 	s   *scanner
 	buf struct {
-		tok token  // last read token
-		lit string // last read literal
-		n   int    // buffer size (max=1)
+		tok  token  // last read token
+		lit  string // last read literal
+		span Span   // span of the last read token
+		n    int    // buffer size (max=1)
 	}
 }
 
@@ -22,36 +26,103 @@ func newParser(r io.Reader) *parser {
 	return &parser{s: newScanner(r)}
 }
 
+// scan returns the next token from the underlying scanner.
+// If a token has been unscanned then read that instead.
+func (p *parser) scan() (tok token, lit string, span Span) {
+	if p.buf.n != 0 {
+		p.buf.n = 0
+		return p.buf.tok, p.buf.lit, p.buf.span
+	}
+
+	tok, lit, span = p.s.Scan()
+	p.buf.tok, p.buf.lit, p.buf.span = tok, lit, span
+	return
+}
+
+// unscan pushes the previously read token back onto the buffer.
+func (p *parser) unscan() { p.buf.n = 1 }
+
 // scanIgnoreWhitespace scans the next non-whitespace token.
-func (p *parser) scanIgnoreWhitespace() (tok token, lit string) {
-	tok, lit = p.s.Scan()
+func (p *parser) scanIgnoreWhitespace() (tok token, lit string, span Span) {
+	tok, lit, span = p.scan()
 	if tok == tokWhitespace {
-		tok, lit = p.s.Scan()
+		tok, lit, span = p.scan()
 	}
 	return
 }
 
+//syntaxError builds the error reporting an invalid part of the source
+func syntaxError(span Span, msg string, expected ...string) *SyntaxError {
+	return &SyntaxError{Msg: msg, Span: span, Expected: expected}
+}
+
+//unaryPrecedence is the precedence of prefix operators, tighter than any binary operator but the power:
+//-2 ** 2 is -(2 ** 2)
+const unaryPrecedence = 9
+
 func isRightAssociative(o string) bool {
-	return o == "^"
+	return o == "**" || o == "?" || o == "?:" || o == "??"
 }
 func precedence(o string) int {
 	switch o {
-	case "*", "/", "%":
+	case "**":
+		return 10
+	case "*", "/", "%", "<<", ">>", "&", "&^":
+		return 8
+	case "+", "-", "|", "^":
+		return 7
+	case "<", "<=", ">", ">=", "in", "match":
 		return 6
-	case "+", "-":
+	case "==", "!=":
 		return 5
-	case "<", "<=", ">", ">=", "in":
+	case "&&":
 		return 4
-	case "==", "!=":
+	case "||":
 		return 3
-	case "&&":
+	case "??":
 		return 2
-	case "||":
+	case "?", "?:":
 		return 1
 	}
 	return 0
 }
 
+//integer returns the literal of an integer, decimal or prefixed by 0x, 0o or 0b, as scanned:
+//a float literal when it is out of the range of int
+func integer(lit string, span Span) (Expression, error) {
+	i, err := strconv.ParseInt(strings.Replace(lit, "_", "", -1), base(lit), 0)
+	if err != nil {
+		f, _, err := big.ParseFloat(lit, 0, 53, big.ToNearestEven)
+		if err != nil {
+			return nil, syntaxError(span, fmt.Sprintf("Illegal token: '%s'", lit))
+		}
+		v, _ := f.Float64()
+		if math.IsInf(v, 0) {
+			return nil, outOfRange(lit, span)
+		}
+		return FloatLiteral{Value: v, span: span}, nil
+	}
+	return IntLiteral{Value: int(i), span: span}, nil
+}
+
+//base returns the base of an integer literal for strconv.ParseInt: 0 when it is prefixed, 10 otherwise
+func base(lit string) int {
+	if len(lit) > 1 && isBasePrefix(rune(lit[1])) {
+		return 0
+	}
+	return 10
+}
+
+//isMinIntMagnitude is true for an integer literal whose negation is the lowest int
+func isMinIntMagnitude(lit string) bool {
+	i, err := strconv.ParseInt("-"+strings.Replace(lit, "_", "", -1), base(lit), 0)
+	return err == nil && i == int64(minInt)
+}
+
+func outOfRange(lit string, span Span) error {
+	return syntaxError(span, fmt.Sprintf("Number out of range: '%s'", lit))
+}
+
 type stack []Expression
 
 func (s *stack) Push(v Expression) {
@@ -64,71 +135,333 @@ func (s *stack) Pop() Expression {
 	return r
 }
 
-type opStack []string
+//operator is an entry of the operator stack: a binary or prefix operator, or a group opening: '(', '[' or '{'
+type operator struct {
+	lit   string
+	unary bool
+	span  Span
+
+	//A group opening records in height the size of the operand stack when it was opened
+	//(for an index, the indexed operand is then on top of the stack).
+	//When the group holds items separated by ',' (or ':' in a map), list is true and items is the number
+	//of items already separated. The arguments of a function call are such items, function being the called function.
+	list     bool
+	function string
+	height   int
+	items    int
+}
 
-func (s *opStack) Push(v string) {
+//isOpening is true for the operators opening a group
+func (o operator) isOpening() bool {
+	return o.lit == "(" || o.lit == "[" || o.lit == "{"
+}
+
+func (o operator) precedence() int {
+	if o.unary {
+		return unaryPrecedence
+	}
+	return precedence(o.lit)
+}
+
+type opStack []operator
+
+func (s *opStack) Push(v operator) {
 	*s = append(*s, v)
 }
-func (s *opStack) Pop() string {
+func (s *opStack) Pop() operator {
 	l := len(*s)
 	r := (*s)[l-1]
 	*s = (*s)[:l-1]
 	return r
 }
-func (s *opStack) Peek() string {
+func (s *opStack) Peek() operator {
 	l := len(*s)
 	return (*s)[l-1]
 }
 
-func addNode(s *stack, v string) error {
+func addNode(s *stack, o operator) error {
+	switch o.lit {
+	case "?":
+		return syntaxError(o.span, "Missing ':' in conditional expression", "':'")
+	case "?:":
+		if len(*s) < 3 {
+			return syntaxError(o.span, "invalid expression", "operand")
+		}
+		no := s.Pop()
+		yes := s.Pop()
+		condition := s.Pop()
+		s.Push(ConditionalExpression{
+			Condition: condition,
+			Yes:       yes,
+			No:        no,
+			span:      Span{Start: spanOf(condition).Start, End: spanOf(no).End},
+		})
+		return nil
+	}
+	if o.unary {
+		if len(*s) < 1 {
+			return syntaxError(o.span, "invalid expression", "operand")
+		}
+		operand := s.Pop()
+		s.Push(UnaryExpression{
+			Operator: o.lit,
+			Operand:  operand,
+			span:     Span{Start: o.span.Start, End: spanOf(operand).End},
+		})
+		return nil
+	}
 	if len(*s) < 2 {
-		return errors.New("invalid expression")
+		return syntaxError(o.span, "invalid expression", "operand")
 	}
 	r := s.Pop()
 	l := s.Pop()
-	s.Push(binaryExpression{
-		operator: v,
-		left:     l,
-		right:    r,
+	if pattern, ok := r.(StringLiteral); ok && o.lit == "match" {
+		//Compile literal patterns once and for all
+		re, err := regexp.Compile(pattern.Value)
+		if err != nil {
+			return syntaxError(pattern.span, fmt.Sprintf("Invalid regular expression: %s", err))
+		}
+		r = PatternLiteral{re, pattern.span}
+	}
+	s.Push(BinaryExpression{
+		Operator: o.lit,
+		Left:     l,
+		Right:    r,
+		span:     Span{Start: spanOf(l).Start, End: spanOf(r).End},
 	})
 	return nil
 }
 
+//reduce adds the nodes of all pending operators down to the innermost group opening, which is left on the stack.
+//If untilCondition is true, it also stops on the '?' of a conditional expression.
+func reduce(operatorStack *opStack, operandStack *stack, untilCondition bool) error {
+	for len(*operatorStack) != 0 {
+		if o := operatorStack.Peek(); o.isOpening() || (untilCondition && o.lit == "?") {
+			return nil
+		}
+		err := addNode(operandStack, operatorStack.Pop())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//popItems pops the items of the group opened by o
+func popItems(s *stack, o operator) ([]Expression, error) {
+	n := len(*s) - o.height
+	if n != o.items+1 && !(n == 0 && o.items == 0) {
+		return nil, syntaxError(o.span, "invalid expression")
+	}
+	items := make([]Expression, n)
+	for i := n - 1; i >= 0; i-- {
+		items[i] = s.Pop()
+	}
+	return items, nil
+}
+
+//addGroup pushes the node built from the operands of the group opened by o and closed by the token at closing:
+//a function call, a list or a map literal, or an index. A parenthesized expression is left as is.
+func addGroup(s *stack, o operator, closing Span) error {
+	span := Span{Start: o.span.Start, End: closing.End}
+	switch {
+	case o.lit == "[" && !o.list:
+		if len(*s) != o.height+1 {
+			return syntaxError(o.span, "invalid expression")
+		}
+		i := s.Pop()
+		object := s.Pop()
+		s.Push(IndexExpression{
+			Object: object,
+			Index:  i,
+			span:   Span{Start: spanOf(object).Start, End: closing.End},
+		})
+	case o.list:
+		items, err := popItems(s, o)
+		if err != nil {
+			return err
+		}
+		switch o.lit {
+		case "(":
+			s.Push(CallExpression{
+				Function: o.function,
+				Args:     items,
+				span:     span,
+			})
+		case "[":
+			s.Push(ListLiteral{Items: items, span: span})
+		case "{":
+			if len(items)%2 != 0 {
+				return syntaxError(closing, "Missing ':' in map literal", "':'")
+			}
+			m := MapLiteral{span: span}
+			for i := 0; i < len(items); i += 2 {
+				m.Entries = append(m.Entries, MapEntry{Key: items[i], Value: items[i+1]})
+			}
+			s.Push(m)
+		}
+	}
+	return nil
+}
+
+//groupOpenings gives the opening of the group ended by each closing token
+var groupOpenings = map[token]string{
+	tokRightParenthesis: "(",
+	tokRightBracket:     "[",
+	tokRightBrace:       "{",
+}
+
+//groupClosings gives the closing of the group started by each opening
+var groupClosings = map[string]string{
+	"(": "')'",
+	"[": "']'",
+	"{": "'}'",
+}
+
+var unbalancedClosings = map[token]string{
+	tokRightParenthesis: "Unbalanced right parenthesis",
+	tokRightBracket:     "Unbalanced right bracket",
+	tokRightBrace:       "Unbalanced right brace",
+}
+
+//isEmptyGroup is true when the innermost group can be closed without any item: '()' of a call, '[]' or '{}'
+func isEmptyGroup(operatorStack opStack, operandStack stack) bool {
+	if len(operatorStack) == 0 {
+		return false
+	}
+	o := operatorStack.Peek()
+	return o.list && o.items == 0 && len(operandStack) == o.height
+}
+
 func (p *parser) Parse() (Expression, error) {
 
 	var operatorStack opStack
 	var operandStack stack
 
+	//expectOperand is true when the next token starts an operand, i.e. an operator found there is a prefix one
+	expectOperand := true
+
+	//Errors for tokens found where an operand, or an operator, was expected
+	missingOperand := func(span Span) error {
+		return syntaxError(span, "invalid expression", "operand")
+	}
+	missingOperator := func(span Span) error {
+		return syntaxError(span, "invalid syntax", "operator")
+	}
+
 main:
 	for {
-		tok, lit := p.scanIgnoreWhitespace()
+		tok, lit, span := p.scanIgnoreWhitespace()
 
 		switch tok {
 		case tokEOF:
+			if len(operandStack) == 0 && len(operatorStack) == 0 {
+				return nil, syntaxError(span, "invalid syntax", "operand")
+			}
+			if expectOperand {
+				return nil, missingOperand(span)
+			}
 			break main
 		case tokIllegal:
-			return nil, fmt.Errorf("Illegal token: '%s'", lit)
+			return nil, syntaxError(span, fmt.Sprintf("Illegal token: '%s'", lit))
+		case tokError:
+			return nil, syntaxError(span, lit)
 		case tokLeftParenthesis:
-			operatorStack.Push(lit)
-		case tokRightParenthesis:
-			for len(operatorStack) != 0 {
-				popped := operatorStack.Pop()
-				if popped == "(" {
-					continue main
-				} else {
-					err := addNode(&operandStack, popped)
-					if err != nil {
-						return nil, err
-					}
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			operatorStack.Push(operator{lit: lit, span: span})
+		case tokLeftBracket:
+			//In place of an operand, a bracket opens a list literal; after an operand, an index
+			operatorStack.Push(operator{lit: lit, span: span, list: expectOperand, height: len(operandStack)})
+			expectOperand = true
+		case tokLeftBrace:
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			operatorStack.Push(operator{lit: lit, span: span, list: true, height: len(operandStack)})
+		case tokRightParenthesis, tokRightBracket, tokRightBrace:
+			if expectOperand && !isEmptyGroup(operatorStack, operandStack) {
+				return nil, missingOperand(span)
+			}
+			expectOperand = false
+			err := reduce(&operatorStack, &operandStack, false)
+			if err != nil {
+				return nil, err
+			}
+			if len(operatorStack) == 0 || operatorStack.Peek().lit != groupOpenings[tok] {
+				return nil, syntaxError(span, unbalancedClosings[tok])
+			}
+			err = addGroup(&operandStack, operatorStack.Pop(), span)
+			if err != nil {
+				return nil, err
+			}
+		case tokComma, tokColon:
+			if expectOperand {
+				return nil, missingOperand(span)
+			}
+			err := reduce(&operatorStack, &operandStack, tok == tokColon)
+			if err != nil {
+				return nil, err
+			}
+			if tok == tokColon && len(operatorStack) != 0 && operatorStack.Peek().lit == "?" {
+				//The 'yes' branch is complete: the conditional now waits for the 'no' branch
+				operatorStack[len(operatorStack)-1].lit = "?:"
+				expectOperand = true
+				continue main
+			}
+			if len(operatorStack) == 0 || !operatorStack.Peek().list {
+				return nil, syntaxError(span, fmt.Sprintf("Unexpected '%s'", lit))
+			}
+			group := &operatorStack[len(operatorStack)-1]
+			//Map entries alternate keys, followed by ':', and values, followed by ','
+			if (tok == tokColon) != (group.lit == "{" && group.items%2 == 0) {
+				if tok == tokColon {
+					return nil, syntaxError(span, "Unexpected ':'", "','", groupClosings[group.lit])
 				}
+				return nil, syntaxError(span, "Unexpected ','", "':'")
+			}
+			if len(operandStack) != group.height+group.items+1 {
+				return nil, missingOperand(span)
 			}
-			return nil, errors.New("Unbalanced right parenthesis")
+			group.items++
+			expectOperand = true
+		case tokDot, tokOptionalDot:
+			if expectOperand {
+				return nil, missingOperand(span)
+			}
+			next, name, nameSpan := p.scanIgnoreWhitespace()
+			if next != tokIdentifier {
+				return nil, syntaxError(nameSpan, fmt.Sprintf("Identifier expected after '%s'", lit), "identifier")
+			}
+			//Member access binds tighter than any operator: it applies directly to the last operand
+			object := operandStack.Pop()
+			operandStack.Push(MemberExpression{
+				Object:   object,
+				Name:     name,
+				Optional: tok == tokOptionalDot,
+				span:     Span{Start: spanOf(object).Start, End: nameSpan.End},
+			})
 		case tokOperator:
-			o1 := lit
+			if expectOperand {
+				if !isUnaryOperator(lit) {
+					return nil, missingOperand(span)
+				}
+				//A prefix operator has no left operand: nothing to reduce yet
+				operatorStack.Push(operator{lit: lit, span: span, unary: true})
+				continue main
+			}
+			if precedence(lit) == 0 {
+				return nil, syntaxError(span, fmt.Sprintf("Unsupported operator '%s'", lit), "operator")
+			}
+			o1 := operator{lit: lit, span: span}
 			for len(operatorStack) > 0 {
 				o2 := operatorStack.Peek()
 
-				if (!isRightAssociative(o1) && precedence(o1) == precedence(o2)) || precedence(o1) < precedence(o2) {
+				if o2.isOpening() {
+					break
+				}
+				if (!isRightAssociative(o1.lit) && o1.precedence() == o2.precedence()) || o1.precedence() < o2.precedence() {
 					operatorStack.Pop()
 					err := addNode(&operandStack, o2)
 					if err != nil {
@@ -139,34 +472,77 @@ main:
 				}
 			}
 			operatorStack.Push(o1)
+			expectOperand = true
 		case tokString:
-			operandStack.Push(stringExpression(lit))
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			expectOperand = false
+			operandStack.Push(StringLiteral{Value: lit, span: span})
 		case tokInt:
-			i, err := strconv.Atoi(lit)
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			expectOperand = false
+			e, err := integer(lit, span)
 			if err != nil {
 				return nil, err
 			}
-			operandStack.Push(intExpression(i))
+			if len(operatorStack) > 0 && isMinIntMagnitude(lit) {
+				//The negation of the literal is the lowest int, unless the power applies first, as in '-9223372036854775808 ** 2'
+				if o := operatorStack.Peek(); o.unary && o.lit == "-" {
+					next, nextLit, _ := p.scanIgnoreWhitespace()
+					p.unscan()
+					if next != tokOperator || nextLit != "**" {
+						operatorStack.Pop()
+						e = IntLiteral{Value: minInt, span: Span{Start: o.span.Start, End: span.End}}
+					}
+				}
+			}
+			operandStack.Push(e)
 		case tokFloat:
-			f, err := strconv.ParseFloat(lit, 64)
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			expectOperand = false
+			f, err := strconv.ParseFloat(strings.Replace(lit, "_", "", -1), 64)
 			if err != nil {
-				return nil, err
+				return nil, outOfRange(lit, span)
 			}
-			operandStack.Push(floatExpression(f))
+			operandStack.Push(FloatLiteral{Value: f, span: span})
 		case tokIdentifier:
-			operandStack.Push(identExpression(lit))
+			if !expectOperand {
+				return nil, missingOperator(span)
+			}
+			if next, _, nextSpan := p.scanIgnoreWhitespace(); next == tokLeftParenthesis {
+				operatorStack.Push(operator{
+					lit:      "(",
+					span:     Span{Start: span.Start, End: nextSpan.End},
+					list:     true,
+					function: lit,
+					height:   len(operandStack),
+				})
+				continue main
+			}
+			p.unscan()
+			expectOperand = false
+			operandStack.Push(Identifier{Name: lit, span: span})
 		}
 	}
 
 	for len(operatorStack) > 0 {
-		err := addNode(&operandStack, operatorStack.Pop())
+		popped := operatorStack.Pop()
+		if popped.isOpening() {
+			return nil, syntaxError(popped.span, "invalid expression", groupClosings[popped.lit])
+		}
+		err := addNode(&operandStack, popped)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if len(operandStack) == 0 || len(operandStack) > 1 {
-		return nil, errors.New("invalid syntax")
+	if len(operandStack) != 1 {
+		return nil, syntaxError(spanOf(operandStack[len(operandStack)-1]), "invalid syntax")
 	}
 
 	return operandStack.Pop(), nil
@@ -0,0 +1,32 @@
+package gript
+
+import "fmt"
+
+//Position is a location in the source of an expression
+type Position struct {
+	Offset int //Offset in bytes, starting at 0
+	Line   int //Line number, starting at 1
+	Column int //Column number in characters, starting at 1
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+//Span is the part of the source of an expression covered by a token or an expression, End being excluded
+type Span struct {
+	Start Position
+	End   Position
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("%s-%s", s.Start, s.End)
+}
+
+//spanOf returns the span of an expression built by the parser, or an empty span for other expressions
+func spanOf(e Expression) Span {
+	if n, ok := e.(interface{ Span() Span }); ok {
+		return n.Span()
+	}
+	return Span{}
+}
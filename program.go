@@ -0,0 +1,144 @@
+package gript
+
+import "context"
+
+//Program is a compiled expression, that can be run many times against different contexts.
+//A Program is immutable: it can be run concurrently from many goroutines.
+type Program struct {
+	source     string
+	expression Expression
+	optimized  Expression //the expression tree whose constant parts are evaluated
+	code       bytecode   //the optimized expression compiled to run on the vm
+	functions  Functions
+	strict     bool
+	limits     Limits
+}
+
+//Option configures the compilation of a Program
+type Option func(p *Program)
+
+//WithFunctions allows the program to call the given functions, in addition to the ones
+//provided by the context it is run against. On a name conflict, the given functions win.
+func WithFunctions(functions Functions) Option {
+	return func(p *Program) {
+		if p.functions == nil {
+			p.functions = Functions{}
+		}
+		for name, fn := range functions {
+			p.functions[name] = fn
+		}
+	}
+}
+
+//WithStrictFloatDivision makes a division of floats by zero fail with a *DivisionByZeroError,
+//instead of giving an infinity or NaN
+func WithStrictFloatDivision() Option {
+	return func(p *Program) {
+		p.strict = true
+	}
+}
+
+//Compile parses a string to create a program, evaluating its constant parts once and for all.
+//When the string is invalid, the returned error is a *SyntaxError. When a constant part that would always be
+//evaluated fails, its evaluation error is returned, as for "'a' + 1".
+func Compile(s string, opts ...Option) (*Program, error) {
+	exp, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return compileProgram(s, exp, opts)
+}
+
+//CompileExpression creates a program from an expression tree, as built by Parse or rewritten by Rewrite.
+//The errors are the ones of Compile, but syntax errors.
+func CompileExpression(e Expression, opts ...Option) (*Program, error) {
+	return compileProgram("", e, opts)
+}
+
+func compileProgram(s string, exp Expression, opts []Option) (*Program, error) {
+
+	p := &Program{source: s, expression: exp}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.limits.MaxDepth > 0 {
+		if n := nested(exp, p.limits.MaxDepth); n != nil {
+			return nil, &LimitError{located{spanOf(n)}, ErrDepthLimit, p.limits.MaxDepth}
+		}
+	}
+
+	//Constant parts are folded under the limits of the values they produce, the steps being counted when running
+	folding := guard{ctx: context.Background(), limits: p.limits}
+	folding.limits.MaxSteps = 0
+	optimized, err := optimize(exp, programContext{variables(nil), p, &folding})
+	if err != nil {
+		return nil, err
+	}
+	p.optimized = optimized
+	p.code = compile(optimized)
+	return p, nil
+}
+
+//Source returns the string the program was compiled from, empty for a program compiled from an expression tree
+func (p *Program) Source() string {
+	return p.source
+}
+
+//Expression returns the expression tree the program was compiled from
+func (p *Program) Expression() Expression {
+	return p.expression
+}
+
+//Run evaluates the program against a context. A panic during the evaluation is returned as a *PanicError.
+func (p *Program) Run(c Context) (interface{}, error) {
+	if p.limits != (Limits{}) {
+		return p.RunContext(context.Background(), c)
+	}
+	return p.code.run(p.context(c), nil)
+}
+
+//RunContext evaluates the program against a context, as Run does, stopping with the error of ctx
+//when ctx is cancelled or its deadline expires. Host functions are not interrupted.
+func (p *Program) RunContext(ctx context.Context, c Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g := guard{ctx: ctx, limits: p.limits}
+	return p.code.run(programContext{c, p, &g}, &g)
+}
+
+//context provides the functions and options of the program to the context it is run against
+func (p *Program) context(c Context) Context {
+	if p.functions != nil || p.strict {
+		return programContext{Context: c, program: p}
+	}
+	return c
+}
+
+//Eval evaluates the program against a set of variables
+func (p *Program) Eval(values map[string]interface{}) (interface{}, error) {
+	return p.Run(variables(values))
+}
+
+//programContext provides the functions and options of a program to the context it is run against,
+//and the guard of the run when it is run with RunContext
+type programContext struct {
+	Context
+	program *Program
+	guard   *guard
+}
+
+func (c programContext) Function(name string) (interface{}, bool) {
+	if fn, found := c.program.functions[name]; found {
+		return fn, true
+	}
+	if fc, ok := c.Context.(FunctionContext); ok {
+		return fc.Function(name)
+	}
+	return nil, false
+}
+
+func (c programContext) strictFloatDivision() bool {
+	return c.program.strict || isStrictFloatDivision(c.Context)
+}
@@ -3,35 +3,66 @@ package gript
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"strconv"
 )
 
 // scanner represents a lexical scanner.
 type scanner struct {
 	r    *bufio.Reader
-	last token
+	pos  Position // position of the next rune
+	prev Position // position of the last read rune, restored by unread
 }
 
 // newScanner returns a new instance of Scanner.
+// The buffer of a source held in memory, as a *bytes.Buffer, is no larger than the source.
 func newScanner(r io.Reader) *scanner {
-	return &scanner{r: bufio.NewReader(r)}
+	size := 4096
+	if b, ok := r.(interface{ Len() int }); ok && b.Len() < size {
+		size = b.Len()
+	}
+	return &scanner{r: bufio.NewReaderSize(r, size), pos: Position{Line: 1, Column: 1}}
 }
 
 // read reads the next rune from the bufferred reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *scanner) read() rune {
-	ch, _, err := s.r.ReadRune()
+	ch, size, err := s.r.ReadRune()
 	if err != nil {
 		return eof
 	}
+	s.prev = s.pos
+	s.pos.Offset += size
+	if ch == '\n' {
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column++
+	}
 	return ch
 }
 
+// peek returns the next byte without reading it, or 0 at the end of the source.
+func (s *scanner) peek() byte {
+	next, err := s.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return next[0]
+}
+
 // unread places the previously read rune back on the reader.
-func (s *scanner) unread() { _ = s.r.UnreadRune() }
+func (s *scanner) unread() {
+	if s.r.UnreadRune() == nil {
+		s.pos = s.prev
+	}
+}
 
-// Scan returns the next token and literal value.
-func (s *scanner) Scan() (tok token, lit string) {
+// Scan returns the next token, its literal value and its span in the source.
+func (s *scanner) Scan() (tok token, lit string, span Span) {
+
+	start := s.pos
 
 	// Read the next rune.
 	ch := s.read()
@@ -44,15 +75,14 @@ func (s *scanner) Scan() (tok token, lit string) {
 	} else if isLetter(ch) {
 		s.unread()
 		tok, lit = s.scanIdent()
-	} else if isDigit(ch) || (isMinusOrPlus(ch) && (s.last == tokIllegal || s.last == tokLeftParenthesis || s.last == tokOperator)) {
-		s.unread()
-		tok, lit = s.scanNumber()
+	} else if isDigit(ch) {
+		tok, lit = s.scanNumber(ch)
 	} else if isOperator(ch) {
 		s.unread()
 		tok, lit = s.scanOperator()
 	} else if isQuote(ch) {
 		s.unread()
-		tok, lit = s.scanString()
+		return s.scanString(start)
 	} else {
 
 		// Otherwise read the individual character.
@@ -63,15 +93,32 @@ func (s *scanner) Scan() (tok token, lit string) {
 			tok, lit = tokLeftParenthesis, "("
 		case ')':
 			tok, lit = tokRightParenthesis, ")"
+		case '[':
+			tok, lit = tokLeftBracket, "["
+		case ']':
+			tok, lit = tokRightBracket, "]"
+		case '{':
+			tok, lit = tokLeftBrace, "{"
+		case '}':
+			tok, lit = tokRightBrace, "}"
+		case ',':
+			tok, lit = tokComma, ","
+		case ':':
+			tok, lit = tokColon, ":"
+		case '.':
+			if isDigit(rune(s.peek())) {
+				tok, lit = s.scanNumber(ch)
+				break
+			}
+			tok, lit = tokDot, "."
+		case '?':
+			tok, lit = s.scanQuestionMark()
 		default:
 			tok, lit = tokIllegal, string(ch)
 		}
 	}
 
-	if tok != tokWhitespace {
-		s.last = tok
-	}
-	return tok, lit
+	return tok, lit, Span{Start: start, End: s.pos}
 }
 
 // scanWhitespace consumes the current rune and all contiguous whitespace.
@@ -124,78 +171,212 @@ func (s *scanner) scanIdent() (tok token, lit string) {
 	return tokIdentifier, v
 }
 
-// scanNumber consumes the current rune and all contiguous runes creating an int or a float.
-func (s *scanner) scanNumber() (tok token, lit string) {
-	// Create a buffer and read the current character into it.
+// scanNumber consumes all the runes following the current one, ch, creating an int or a float: a decimal number with
+// an optional fraction and exponent, as '42', '.5' or '2.5e-3', or an integer prefixed by 0x, 0o or 0b, as '0xFF'.
+// Underscores may separate the digits, as in '1_000_000'.
+func (s *scanner) scanNumber(ch rune) (tok token, lit string) {
+	// Create a buffer and write the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	buf.WriteRune(ch)
 
 	tok = tokInt
+	if ch == '0' && isBasePrefix(rune(s.peek())) {
+		prefix := s.read()
+		buf.WriteRune(prefix)
+		digits := isDigit
+		if prefix == 'x' || prefix == 'X' {
+			digits = isHexDigit
+		}
+		s.scanDigits(&buf, digits)
+		if _, err := strconv.ParseInt(buf.String(), 0, 64); err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+			return tokIllegal, buf.String()
+		}
+		// A literal out of range is not checked by ParseInt: check its underscores, the prefix counting as a digit
+		if !isSeparated("0"+buf.String()[2:], digits) {
+			return tokIllegal, buf.String()
+		}
+		return tok, buf.String()
+	}
 
-	// Read every subsequent ident character into the buffer.
-	// Non-int characters and EOF will cause the loop to exit.
+	if isDot(ch) {
+		tok = tokFloat
+	} else {
+		s.scanDigits(&buf, isDigit)
+		if isDot(rune(s.peek())) {
+			tok = tokFloat
+			buf.WriteRune(s.read())
+		}
+	}
+	if tok == tokFloat {
+		s.scanDigits(&buf, isDigit)
+		if isDot(rune(s.peek())) {
+			// A second dot, as in '1.1.'
+			buf.WriteRune(s.read())
+			return tokIllegal, buf.String()
+		}
+	}
+
+	if next := s.peek(); next == 'e' || next == 'E' {
+		tok = tokFloat
+		buf.WriteRune(s.read())
+		if next := s.peek(); next == '+' || next == '-' {
+			buf.WriteRune(s.read())
+		}
+		if s.scanDigits(&buf, isDigit) == 0 {
+			return tokIllegal, buf.String()
+		}
+	}
+
+	if !isSeparated(buf.String(), isDigit) {
+		return tokIllegal, buf.String()
+	}
+	return tok, buf.String()
+}
+
+// scanDigits consumes the contiguous digits and underscores, returning their number.
+func (s *scanner) scanDigits(buf *bytes.Buffer, digits func(rune) bool) int {
+	n := 0
 	for {
 		if ch := s.read(); ch == eof {
-			break
-		} else if !isDigit(ch) && !isDot(ch) {
+			return n
+		} else if !digits(ch) && ch != '_' {
 			s.unread()
-			break
+			return n
 		} else {
 			_, _ = buf.WriteRune(ch)
-			if isDot(ch) {
-				if tok == tokInt {
-					tok = tokFloat
-				} else {
-					return tokIllegal, buf.String()
-				}
-			}
+			n++
 		}
 	}
+}
 
-	// Otherwise return as a regular identifier.
-	return tok, buf.String()
+// isSeparated is true when the underscores of a number are between digits.
+func isSeparated(lit string, digits func(rune) bool) bool {
+	for i := 0; i < len(lit); i++ {
+		if lit[i] == '_' && (i == 0 || i == len(lit)-1 || !digits(rune(lit[i-1])) || !digits(rune(lit[i+1]))) {
+			return false
+		}
+	}
+	return true
 }
 
-// scanOperator consumes the current rune and all contiguous operator.
+// scanOperator consumes the current rune and the next one when they form a two-rune operator.
+// Operators are never glued further, so that in 'a&-1' or '1 >>-2' the prefix operator starts the next operand.
 func (s *scanner) scanOperator() (tok token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
 	buf.WriteRune(s.read())
 
-	// Read every subsequent operator character into the buffer.
-	// Non-operator characters and EOF will cause the loop to exit.
-	for {
-		if ch := s.read(); ch == eof {
-			break
-		} else if !isOperator(ch) {
-			s.unread()
-			break
-		} else {
-			_, _ = buf.WriteRune(ch)
-		}
+	if ch := s.read(); ch == eof {
+		return tokOperator, buf.String()
+	} else if isTwoRuneOperator(buf.String() + string(ch)) {
+		_, _ = buf.WriteRune(ch)
+	} else {
+		s.unread()
 	}
 
 	return tokOperator, buf.String()
 }
 
-// scanString consumes the current rune (quote) and all rune until next quote
-func (s *scanner) scanString() (tok token, lit string) {
+// scanQuestionMark scans the operators starting with the current question mark: '?', '??' and '?.'.
+// As in 'a ?.5 : 1', a dot followed by a digit does not make a '?.'.
+func (s *scanner) scanQuestionMark() (tok token, lit string) {
+	next, _ := s.r.Peek(2)
+	switch {
+	case len(next) > 0 && next[0] == '?':
+		s.read()
+		return tokOperator, "??"
+	case len(next) > 0 && next[0] == '.' && (len(next) == 1 || !isDigit(rune(next[1]))):
+		s.read()
+		return tokOptionalDot, "?."
+	}
+	return tokOperator, "?"
+}
+
+// scanString consumes the current rune (quote) and all runes until the matching quote, starting at start.
+// Strings within single or double quotes end on their line and decode Go escape sequences, as '\'' or "\u00e9";
+// strings within backquotes are raw and may span several lines.
+// An unterminated string or an invalid escape sequence gives a tokError, with its message and span.
+func (s *scanner) scanString(start Position) (tok token, lit string, span Span) {
 
 	var buf bytes.Buffer
 	q := s.read() //Skip first quote
 
+	unterminated := Span{Start: start, End: Position{Offset: start.Offset + 1, Line: start.Line, Column: start.Column + 1}}
+
 	// Read every subsequent character into the buffer.
 	// Quote and EOF will cause the loop to exit.
 	for {
-		if ch := s.read(); ch == eof {
-			return tokIllegal, buf.String()
-		} else if ch == q {
-			break
-		} else {
+		ch := s.read()
+		switch {
+		case ch == eof, ch == '\n' && q != '`':
+			return tokError, "Unterminated string", unterminated
+		case ch == q:
+			return tokString, buf.String(), Span{Start: start, End: s.pos}
+		case ch == '\\' && q != '`':
+			escape := s.prev
+			seq, ok := s.scanEscape()
+			if !ok {
+				return tokError, "Unterminated string", unterminated
+			}
+			if err := unescape(&buf, seq); err != nil {
+				return tokError, fmt.Sprintf("Invalid escape sequence: '%s'", seq), Span{Start: escape, End: s.pos}
+			}
+		default:
 			_, _ = buf.WriteRune(ch)
 		}
 	}
+}
 
-	return tokString, buf.String()
+// scanEscape consumes an escape sequence after its backslash, giving false when the source ends within the sequence.
+func (s *scanner) scanEscape() (seq string, ok bool) {
 
+	ch := s.read()
+	if ch == eof {
+		return "", false
+	}
+	seq = `\` + string(ch)
+
+	digits := 0
+	switch {
+	case ch == 'x':
+		digits = 2
+	case ch == 'u':
+		digits = 4
+	case ch == 'U':
+		digits = 8
+	case ch >= '0' && ch <= '7':
+		digits = 2
+	}
+	for i := 0; i < digits; i++ {
+		ch := s.read()
+		if ch == eof {
+			return "", false
+		}
+		if !isHexDigit(ch) {
+			//The sequence is too short: the character ending it, as a closing quote, is not part of it
+			s.unread()
+			break
+		}
+		seq += string(ch)
+	}
+	return seq, true
+}
+
+// unescape writes the character of an escape sequence, or fails when the sequence is invalid.
+func unescape(buf *bytes.Buffer, seq string) error {
+
+	if seq == `\'` || seq == `\"` {
+		buf.WriteByte(seq[1])
+		return nil
+	}
+	v, multibyte, tail, err := strconv.UnquoteChar(seq, 0)
+	if err != nil || tail != "" {
+		return strconv.ErrSyntax
+	}
+	if multibyte {
+		buf.WriteRune(v)
+	} else {
+		buf.WriteByte(byte(v))
+	}
+	return nil
 }
@@ -4,11 +4,20 @@ type token int
 
 const (
 	tokIllegal token = iota
+	tokError         //Invalid token, its literal being the message describing the error
 	tokEOF
 	tokWhitespace
 
 	tokLeftParenthesis
 	tokRightParenthesis
+	tokLeftBracket
+	tokRightBracket
+	tokLeftBrace
+	tokRightBrace
+	tokComma
+	tokColon
+	tokDot
+	tokOptionalDot
 
 	tokIdentifier
 
@@ -24,11 +33,23 @@ func isWhitespace(ch rune) bool {
 }
 
 func isOperator(ch rune) bool {
-	return ch == '>' || ch == '<' || ch == '=' || ch == '!' || ch == '+' || ch == '-' || ch == '/' || ch == '*' || ch == '|' || ch == '&' || ch == '%'
+	return ch == '>' || ch == '<' || ch == '=' || ch == '!' || ch == '+' || ch == '-' || ch == '/' || ch == '*' || ch == '|' || ch == '&' || ch == '%' || ch == '^'
+}
+
+func isTwoRuneOperator(o string) bool {
+	switch o {
+	case "==", "!=", "<=", ">=", "&&", "||", "**", "<<", ">>", "&^":
+		return true
+	}
+	return false
+}
+
+func isUnaryOperator(o string) bool {
+	return o == "!" || o == "-" || o == "+"
 }
 
 func isLetter(ch rune) bool {
-	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '.'
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
 }
 
 func isMinusOrPlus(ch rune) bool {
@@ -39,6 +60,14 @@ func isDigit(ch rune) bool {
 	return (ch >= '0' && ch <= '9')
 }
 
+func isBasePrefix(ch rune) bool {
+	return ch == 'x' || ch == 'X' || ch == 'o' || ch == 'O' || ch == 'b' || ch == 'B'
+}
+
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
 func isDot(ch rune) bool {
 	return ch == '.'
 }
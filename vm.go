@@ -0,0 +1,363 @@
+package gript
+
+import "reflect"
+
+//stackSize is the size of the stack of the vm allocated along with its run, enough for most expressions
+const stackSize = 16
+
+//run evaluates the bytecode against a context, as the Eval method of the expression does, under the control
+//of a guard when it is not nil. A panic during the evaluation is returned as a *PanicError.
+func (b *bytecode) run(c Context, g *guard) (result interface{}, err error) {
+	if g == nil && len(b.instructions) == 1 && b.instructions[0].op == opConstant {
+		//A constant expression
+		return b.constants[0], nil
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = nil, &PanicError{Value: p}
+		}
+	}()
+
+	//The stack is allocated along with the run, as small as the expression allows
+	var stack []interface{}
+	switch {
+	case b.depth <= 4:
+		var values [4]interface{}
+		stack = values[:]
+	case b.depth <= stackSize:
+		var values [stackSize]interface{}
+		stack = values[:]
+	default:
+		stack = make([]interface{}, b.depth)
+	}
+
+	code := b.instructions
+	sp := 0
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+		if in.step && g != nil {
+			if err = g.step(b.spans[pc]); err != nil {
+				return nil, err
+			}
+		}
+
+		switch in.op {
+		case opConstant:
+			stack[sp] = b.constants[in.a]
+			sp++
+		case opVariable:
+			v, found := c.Value(b.names[in.a])
+			if !found {
+				if in.b >= 0 {
+					err = b.expressions[in.b].(MemberExpression).undefined()
+				} else {
+					err = &UndefinedVariableError{located{b.spans[pc]}, b.names[in.a]}
+				}
+				break
+			}
+			stack[sp] = normalize(v)
+			sp++
+		case opMember, opOptionalMember:
+			v, found := member(stack[sp-1], b.names[in.a])
+			if !found {
+				if in.op == opOptionalMember {
+					stack[sp-1] = nil
+					pc = in.c - 1
+				} else if in.b >= 0 {
+					err = b.expressions[in.b].(MemberExpression).undefined()
+				} else {
+					err = &UndefinedFieldError{located{b.spans[pc]}, b.names[in.a]}
+				}
+				break
+			}
+			if in.op == opOptionalMember {
+				if value := reflect.ValueOf(v); value.Kind() == reflect.Ptr && value.IsNil() {
+					v = nil
+				}
+			}
+			stack[sp-1] = v
+		case opIndex:
+			var v interface{}
+			if v, err = index(stack[sp-2], stack[sp-1]); err != nil {
+				err = locate(err, b.spans[pc])
+				break
+			}
+			sp--
+			stack[sp-1] = v
+		case opFunction:
+			fn, found := lookupFunction(c, b.names[in.a])
+			if !found {
+				err = &UndefinedFunctionError{located{b.spans[pc]}, b.names[in.a]}
+				break
+			}
+			stack[sp] = fn
+			sp++
+		case opCall:
+			if g != nil {
+				//Host functions are not interrupted: check the cancellation before calling them
+				if err = g.ctx.Err(); err != nil {
+					break
+				}
+				if err = g.step(b.spans[pc]); err != nil {
+					break
+				}
+			}
+			args := make([]interface{}, in.a)
+			copy(args, stack[sp-in.a:sp])
+			sp -= in.a
+			var v interface{}
+			if v, err = call(b.names[in.b], stack[sp-1], args); err != nil {
+				err = locate(err, b.spans[pc])
+				break
+			}
+			if g != nil {
+				if err = locate(g.produced(v), b.spans[pc]); err != nil {
+					break
+				}
+			}
+			stack[sp-1] = v
+		case opList:
+			l := make([]interface{}, in.a)
+			copy(l, stack[sp-in.a:sp])
+			if g != nil {
+				if err = locate(g.produced(l), b.spans[pc]); err != nil {
+					break
+				}
+			}
+			sp -= in.a - 1
+			stack[sp-1] = l
+		case opKey:
+			if k := stack[sp-1]; k != nil && !reflect.TypeOf(k).Comparable() {
+				err = locate(mismatch("{}", "unhashable key type in map literal", k), b.spans[pc])
+			}
+		case opMap:
+			entries := stack[sp-2*in.a : sp]
+			var m interface{} = stringMap(entries)
+			if m == nil {
+				mi := make(map[interface{}]interface{}, in.a)
+				for i := 0; i < len(entries); i += 2 {
+					mi[entries[i]] = entries[i+1]
+				}
+				m = mi
+			}
+			if g != nil {
+				if err = locate(g.produced(m), b.spans[pc]); err != nil {
+					break
+				}
+			}
+			sp -= 2*in.a - 1
+			stack[sp-1] = m
+		case opNot:
+			if v, ok := stack[sp-1].(bool); ok {
+				stack[sp-1] = !v
+				break
+			}
+			stack[sp-1], err = not(stack[sp-1])
+		case opNegate:
+			stack[sp-1], err = negation(stack[sp-1])
+		case opIdentity:
+			stack[sp-1], err = identity(stack[sp-1])
+		case opUnary:
+			stack[sp-1], err = unary(b.names[in.a], stack[sp-1])
+		case opEqual, opNotEqual:
+			l, r := stack[sp-2], stack[sp-1]
+			var v bool
+			if vl, ok := l.(int); ok {
+				if vr, ok := r.(int); ok {
+					v = vl == vr
+				} else {
+					v = equal(l, r)
+				}
+			} else {
+				v = equal(l, r)
+			}
+			sp--
+			stack[sp-1] = v == (in.op == opEqual)
+		case opLess, opLessOrEqual, opGreater, opGreaterOrEqual:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if vl, ok := l.(int); ok {
+				if vr, ok := r.(int); ok {
+					stack[sp-1] = compareInts(in.op, vl, vr)
+					break
+				}
+			}
+			if vl, ok := l.(float64); ok {
+				if vr, ok := r.(float64); ok {
+					stack[sp-1] = compareFloats(in.op, vl, vr)
+					break
+				}
+			}
+			stack[sp-1], err = compare(comparisons[in.op-opLess], l, r)
+		case opAnd, opOr:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if vl, ok := l.(bool); ok {
+				if vr, ok := r.(bool); ok {
+					if in.op == opAnd {
+						stack[sp-1] = vl && vr
+					} else {
+						stack[sp-1] = vl || vr
+					}
+					break
+				}
+			}
+			if in.op == opAnd {
+				stack[sp-1], err = and(l, r)
+			} else {
+				stack[sp-1], err = or(l, r)
+			}
+		case opAdd:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if vl, ok := l.(int); ok {
+				if vr, ok := r.(int); ok {
+					stack[sp-1] = vl + vr
+					break
+				}
+			}
+			var v interface{}
+			if v, err = sum(l, r); err != nil {
+				break
+			}
+			if g != nil {
+				if err = locate(g.produced(v), b.spans[pc]); err != nil {
+					break
+				}
+			}
+			stack[sp-1] = v
+		case opSubtract:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if vl, ok := l.(int); ok {
+				if vr, ok := r.(int); ok {
+					stack[sp-1] = vl - vr
+					break
+				}
+			}
+			stack[sp-1], err = difference(l, r)
+		case opMultiply:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if vl, ok := l.(int); ok {
+				if vr, ok := r.(int); ok {
+					stack[sp-1] = vl * vr
+					break
+				}
+			}
+			stack[sp-1], err = product(l, r)
+		case opDivide:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if isFloatDivisionByZero(l, r) && isStrictFloatDivision(c) {
+				err = &DivisionByZeroError{located{b.spans[pc]}, "/", true}
+				break
+			}
+			stack[sp-1], err = quotient(l, r)
+		case opMatch:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			if g != nil {
+				if err = g.matched(l); err != nil {
+					break
+				}
+			}
+			stack[sp-1], err = match(l, r)
+		case opBinary:
+			l, r := stack[sp-2], stack[sp-1]
+			sp--
+			stack[sp-1], err = binary(b.names[in.a], l, r)
+		case opJumpIfFalse, opJumpIfTrue:
+			if v, ok := stack[sp-1].(bool); ok && v == (in.op == opJumpIfTrue) {
+				if g != nil {
+					if err = g.step(b.spans[pc]); err != nil {
+						break
+					}
+				}
+				pc = in.a - 1
+			}
+		case opBranch:
+			sp--
+			condition, ok := stack[sp].(bool)
+			if !ok {
+				err = mismatch("?:", "boolean expected in conditional expression", stack[sp])
+				break
+			}
+			if !condition {
+				pc = in.a - 1
+			}
+		case opJump:
+			pc = in.a - 1
+		case opCoalesce:
+			if stack[sp-1] != nil {
+				pc = in.a - 1
+				break
+			}
+			sp--
+			pc = in.b - 1
+		case opFallback:
+		case opEvaluate:
+			var v interface{}
+			if v, err = b.expressions[in.a].Eval(c); err != nil {
+				//The error of the expression is returned as it is
+				return nil, err
+			}
+			stack[sp] = v
+			sp++
+		}
+
+		if err != nil {
+			if h, chained := b.handlers[pc]; chained && isUndefined(err) {
+				//The left part of the '??' is undefined: its right part gives the result
+				sp, pc = h.height, h.pc-1
+				err = nil
+				continue
+			}
+			return nil, locate(err, b.spans[pc])
+		}
+	}
+	return stack[0], nil
+}
+
+//comparisons are the operators of opLess, opLessOrEqual, opGreater and opGreaterOrEqual
+var comparisons = [...]string{"<", "<=", ">", ">="}
+
+func compareInts(op opcode, l, r int) bool {
+	switch op {
+	case opLess:
+		return l < r
+	case opLessOrEqual:
+		return l <= r
+	case opGreater:
+		return l > r
+	}
+	return l >= r
+}
+
+func compareFloats(op opcode, l, r float64) bool {
+	switch op {
+	case opLess:
+		return l < r
+	case opLessOrEqual:
+		return l <= r
+	case opGreater:
+		return l > r
+	}
+	return l >= r
+}
+
+//stringMap builds the map of keys and values given alternately when all keys are strings, as MapLiteral.Eval does,
+//and returns nil otherwise
+func stringMap(entries []interface{}) interface{} {
+	for i := 0; i < len(entries); i += 2 {
+		if _, ok := entries[i].(string); !ok {
+			return nil
+		}
+	}
+	m := make(map[string]interface{}, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		m[entries[i].(string)] = entries[i+1]
+	}
+	return m
+}